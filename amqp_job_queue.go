@@ -1,17 +1,14 @@
 package worker
 
 import (
-	"encoding/json"
 	"fmt"
 	"time"
 
 	gocontext "context"
 
 	"github.com/Jeffail/tunny"
-	"github.com/bitly/go-simplejson"
 	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
-	"github.com/travis-ci/worker/backend"
 	"github.com/travis-ci/worker/context"
 	"github.com/travis-ci/worker/metrics"
 )
@@ -172,16 +169,15 @@ func (q *AMQPJobQueue) Jobs(ctx gocontext.Context) (outChan <-chan Job, err erro
 				}
 
 				buildJob := &amqpJob{
-					payload:         &JobPayload{},
-					startAttributes: &backend.StartAttributes{},
 					stateUpdatePool: q.stateUpdatePool,
 					withLogSharding: q.withLogSharding,
 				}
-				startAttrs := &jobPayloadStartAttrs{Config: &backend.StartAttributes{}}
 
-				err := json.Unmarshal(delivery.Body, buildJob.payload)
+				var err error
+				buildJob.payload, buildJob.startAttributes, buildJob.rawPayload, err = parseJobPayload(
+					delivery.Body, q.DefaultLanguage, q.DefaultDist, q.DefaultGroup, q.DefaultOS)
 				if err != nil {
-					logger.WithField("err", err).Error("payload JSON parse error, attempting to ack+drop delivery")
+					logger.WithField("err", err).Error("payload parse error, attempting to ack+drop delivery")
 					err := delivery.Ack(false)
 					if err != nil {
 						logger.WithField("err", err).WithField("delivery", delivery).Error("couldn't ack+drop delivery")
@@ -191,31 +187,6 @@ func (q *AMQPJobQueue) Jobs(ctx gocontext.Context) (outChan <-chan Job, err erro
 
 				logger.WithField("job_id", buildJob.payload.Job.ID).Info("received amqp delivery")
 
-				err = json.Unmarshal(delivery.Body, &startAttrs)
-				if err != nil {
-					logger.WithField("err", err).Error("start attributes JSON parse error, attempting to ack+drop delivery")
-					err := delivery.Ack(false)
-					if err != nil {
-						logger.WithField("err", err).WithField("delivery", delivery).Error("couldn't ack+drop delivery")
-					}
-					continue
-				}
-
-				buildJob.rawPayload, err = simplejson.NewJson(delivery.Body)
-				if err != nil {
-					logger.WithField("err", err).Error("raw payload JSON parse error, attempting to ack+drop delivery")
-					err := delivery.Ack(false)
-					if err != nil {
-						logger.WithField("err", err).WithField("delivery", delivery).Error("couldn't ack+drop delivery")
-					}
-					continue
-				}
-
-				buildJob.startAttributes = startAttrs.Config
-				buildJob.startAttributes.VMType = buildJob.payload.VMType
-				buildJob.startAttributes.VMConfig = buildJob.payload.VMConfig
-				buildJob.startAttributes.Warmer = buildJob.payload.Warmer
-				buildJob.startAttributes.SetDefaults(q.DefaultLanguage, q.DefaultDist, q.DefaultGroup, q.DefaultOS, VMTypeDefault, VMConfigDefault)
 				buildJob.conn = q.conn
 				buildJob.logWriterChan = logWriterChannel
 				buildJob.delivery = delivery
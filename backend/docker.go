@@ -357,6 +357,12 @@ func (p *dockerProvider) SupportsProgress() bool {
 	return false
 }
 
+// SupportsVMType returns true for all VM types, as this provider does not
+// distinguish between them.
+func (p *dockerProvider) SupportsVMType(vmType string) bool {
+	return true
+}
+
 func (p *dockerProvider) StartWithProgress(ctx gocontext.Context, startAttributes *StartAttributes, _ Progresser) (Instance, error) {
 	return p.Start(ctx, startAttributes)
 }
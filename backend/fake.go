@@ -29,6 +29,12 @@ func (p *fakeProvider) SupportsProgress() bool {
 	return false
 }
 
+// SupportsVMType returns true for all VM types, as this provider does not
+// distinguish between them.
+func (p *fakeProvider) SupportsVMType(vmType string) bool {
+	return true
+}
+
 func (p *fakeProvider) StartWithProgress(ctx context.Context, startAttributes *StartAttributes, _ Progresser) (Instance, error) {
 	return p.Start(ctx, startAttributes)
 }
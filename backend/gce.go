@@ -910,6 +910,12 @@ func (p *gceProvider) SupportsProgress() bool {
 	return true
 }
 
+// SupportsVMType returns true for the VM types that map to a configured
+// machine type.
+func (p *gceProvider) SupportsVMType(vmType string) bool {
+	return vmType == "default" || vmType == "premium"
+}
+
 func (p *gceProvider) StartWithProgress(ctx gocontext.Context, startAttributes *StartAttributes, progresser Progresser) (Instance, error) {
 	logger := context.LoggerFromContext(ctx).WithField("self", "backend/gce_provider")
 
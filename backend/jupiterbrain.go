@@ -237,6 +237,12 @@ func (p *jupiterBrainProvider) SupportsProgress() bool {
 	return true
 }
 
+// SupportsVMType returns true for all VM types, as this provider does not
+// distinguish between them.
+func (p *jupiterBrainProvider) SupportsVMType(vmType string) bool {
+	return true
+}
+
 func (p *jupiterBrainProvider) Start(ctx gocontext.Context, startAttributes *StartAttributes) (Instance, error) {
 	return p.StartWithProgress(ctx, startAttributes, NewTextProgresser(nil))
 }
@@ -48,6 +48,12 @@ func (p *localProvider) SupportsProgress() bool {
 	return false
 }
 
+// SupportsVMType returns true for all VM types, as this provider does not
+// distinguish between them.
+func (p *localProvider) SupportsVMType(vmType string) bool {
+	return true
+}
+
 func (p *localProvider) StartWithProgress(ctx gocontext.Context, startAttributes *StartAttributes, _ Progresser) (Instance, error) {
 	return p.Start(ctx, startAttributes)
 }
@@ -447,6 +447,12 @@ func (p *osProvider) SupportsProgress() bool {
 	return false
 }
 
+// SupportsVMType returns true for all VM types, as this provider does not
+// distinguish between them.
+func (p *osProvider) SupportsVMType(vmType string) bool {
+	return true
+}
+
 func (p *osProvider) StartWithProgress(ctx gocontext.Context, startAttributes *StartAttributes, _ Progresser) (Instance, error) {
 	return p.Start(ctx, startAttributes)
 }
@@ -76,6 +76,10 @@ type Provider interface {
 
 	// SupportsProgress allows for querying of progress support, yeah!
 	SupportsProgress() bool
+
+	// SupportsVMType reports whether this provider is able to start
+	// instances of the given VM type, such as "default" or "premium".
+	SupportsVMType(string) bool
 }
 
 // An Instance is something that can run a build script.
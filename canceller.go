@@ -2,11 +2,61 @@ package worker
 
 import "sync"
 
+// CancellationReason is why a running job was cancelled, which is logged and
+// explained in the job's log.
+type CancellationReason string
+
+const (
+	// CancellationReasonRequested is used when cancellation of the job was
+	// requested, e.g. by a user via job-board or a cancel_job command.
+	CancellationReasonRequested CancellationReason = "requested"
+
+	// CancellationReasonClaimLost is used when the worker couldn't refresh
+	// its claim on the job, so that job-board may give it to another worker.
+	CancellationReasonClaimLost CancellationReason = "claim_lost"
+
+	// CancellationReasonConflict is used when job-board reported the job as
+	// already received or started, i.e. likely run by another worker.
+	CancellationReasonConflict CancellationReason = "conflict"
+
+	// CancellationReasonTerminated is used when the processor running the
+	// job was terminated, e.g. because the worker is shutting down.
+	CancellationReasonTerminated CancellationReason = "terminated"
+
+	// CancellationReasonHandedBack is used when the job was handed back to
+	// job-board to be run by another worker, e.g. when requeueing running
+	// jobs on shutdown.
+	CancellationReasonHandedBack CancellationReason = "handed_back"
+)
+
+// silent returns whether a job cancelled for this reason is left alone, with
+// nothing written to its log and no state update sent, as it now belongs to
+// whichever worker runs it next.
+func (r CancellationReason) silent() bool {
+	return r == CancellationReasonHandedBack
+}
+
+// logMessage returns the message written at the end of the log of a job
+// cancelled for this reason.
+func (r CancellationReason) logMessage() string {
+	switch r {
+	case CancellationReasonClaimLost:
+		return "\n\nDone: Job Cancelled\n\nThe worker running this job lost its claim on it, so the job may be run again elsewhere.\n\n"
+	case CancellationReasonConflict:
+		return "\n\nDone: Job Cancelled\n\nThis job appears to be running on another worker as well, so it has been stopped here.\n\n"
+	case CancellationReasonTerminated:
+		return "\n\nDone: Job Cancelled\n\nThe worker running this job is shutting down.\n\n"
+	default:
+		return "\n\nDone: Job Cancelled\n\n"
+	}
+}
+
 // A CancellationBroadcaster allows you to subscribe to and unsubscribe from
 // cancellation messages for a given job ID.
 type CancellationBroadcaster struct {
 	registryMutex sync.Mutex
 	registry      map[uint64][](chan struct{})
+	reasons       map[<-chan struct{}]CancellationReason
 }
 
 // NewCancellationBroadcaster sets up a new cancellation broadcaster with an
@@ -14,12 +64,20 @@ type CancellationBroadcaster struct {
 func NewCancellationBroadcaster() *CancellationBroadcaster {
 	return &CancellationBroadcaster{
 		registry: make(map[uint64][](chan struct{})),
+		reasons:  make(map[<-chan struct{}]CancellationReason),
 	}
 }
 
 // Broadcast broacasts a cancellation message to all currently subscribed
-// cancellers.
+// cancellers, with CancellationReasonRequested as the reason.
 func (cb *CancellationBroadcaster) Broadcast(id uint64) {
+	cb.BroadcastReason(id, CancellationReasonRequested)
+}
+
+// BroadcastReason broadcasts a cancellation message to all currently
+// subscribed cancellers, each of which can then look up the given reason
+// with Reason.
+func (cb *CancellationBroadcaster) BroadcastReason(id uint64, reason CancellationReason) {
 	cb.registryMutex.Lock()
 	defer cb.registryMutex.Unlock()
 
@@ -27,10 +85,20 @@ func (cb *CancellationBroadcaster) Broadcast(id uint64) {
 	delete(cb.registry, id)
 
 	for _, ch := range chans {
+		cb.reasons[ch] = reason
 		close(ch)
 	}
 }
 
+// Reason returns the reason a cancellation message was broadcast with to the
+// given subscription, or "" if none was broadcast to it.
+func (cb *CancellationBroadcaster) Reason(ch <-chan struct{}) CancellationReason {
+	cb.registryMutex.Lock()
+	defer cb.registryMutex.Unlock()
+
+	return cb.reasons[ch]
+}
+
 // Subscribe will set up a subscription for cancellation messages for the
 // given job ID. When a cancellation message comes in, the returned channel
 // will be closed.
@@ -53,6 +121,8 @@ func (cb *CancellationBroadcaster) Unsubscribe(id uint64, ch <-chan struct{}) {
 	cb.registryMutex.Lock()
 	defer cb.registryMutex.Unlock()
 
+	delete(cb.reasons, ch)
+
 	// If there's no registered channels for the given ID, just return
 	if _, ok := cb.registry[id]; !ok {
 		return
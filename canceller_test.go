@@ -21,6 +21,32 @@ func TestCancellationBroadcaster(t *testing.T) {
 	assertWaiting(t, "ch2", ch2)
 }
 
+func TestCancellationBroadcaster_Reason(t *testing.T) {
+	cb := NewCancellationBroadcaster()
+
+	ch1 := cb.Subscribe(1)
+	ch2 := cb.Subscribe(2)
+	ch3 := cb.Subscribe(3)
+
+	cb.Broadcast(1)
+	cb.BroadcastReason(2, CancellationReasonClaimLost)
+
+	if reason := cb.Reason(ch1); reason != CancellationReasonRequested {
+		t.Errorf("expected reason %q for ch1, but got %q", CancellationReasonRequested, reason)
+	}
+	if reason := cb.Reason(ch2); reason != CancellationReasonClaimLost {
+		t.Errorf("expected reason %q for ch2, but got %q", CancellationReasonClaimLost, reason)
+	}
+	if reason := cb.Reason(ch3); reason != "" {
+		t.Errorf("expected no reason for ch3, but got %q", reason)
+	}
+
+	cb.Unsubscribe(2, ch2)
+	if reason := cb.Reason(ch2); reason != "" {
+		t.Errorf("expected no reason for ch2 after unsubscribing, but got %q", reason)
+	}
+}
+
 func assertClosed(t *testing.T, name string, ch <-chan struct{}) {
 	select {
 	case _, ok := (<-ch):
@@ -13,6 +13,7 @@ import (
 	"os/exec"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -31,6 +32,7 @@ import (
 	"github.com/getsentry/raven-go"
 	librato "github.com/mihasya/go-metrics-librato"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
@@ -66,6 +68,12 @@ type CLI struct {
 
 	heartbeatErrSleep time.Duration
 	heartbeatSleep    time.Duration
+
+	// httpJobQueue is set once the job queue is set up, which may be after
+	// the remote controller has started serving, so it is guarded by
+	// httpJobQueueMutex.
+	httpJobQueueMutex sync.Mutex
+	httpJobQueue      *HTTPJobQueue
 }
 
 // NewCLI creates a new *CLI from a *cli.Context
@@ -490,11 +498,19 @@ func (i *CLI) heartbeatCheck(heartbeatURL, heartbeatAuthToken string) error {
 
 func (i *CLI) setupRemoteController() {
 	i.logger.Info("setting up remote controller")
+
+	var metrics http.Handler
+	if i.Config.HTTPPrometheusMetrics {
+		metrics = prometheus.Handler()
+	}
+
 	(&RemoteController{
 		pool:       i.ProcessorPool,
 		auth:       i.c.String("remote-controller-auth"),
 		workerInfo: i.workerInfo,
+		queueInfo:  i.queueInfo,
 		cancel:     i.cancel,
+		metrics:    metrics,
 	}).Setup()
 }
 
@@ -516,6 +532,22 @@ func (i *CLI) workerInfo() workerInfo {
 	return info
 }
 
+func (i *CLI) queueInfo() (interface{}, bool) {
+	httpJobQueue := i.currentHTTPJobQueue()
+	if httpJobQueue == nil {
+		return nil, false
+	}
+	return httpJobQueue.Status(), true
+}
+
+// currentHTTPJobQueue returns the http job queue, or nil if there is none (yet).
+func (i *CLI) currentHTTPJobQueue() *HTTPJobQueue {
+	i.httpJobQueueMutex.Lock()
+	defer i.httpJobQueueMutex.Unlock()
+
+	return i.httpJobQueue
+}
+
 func (i *CLI) signalHandler() {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan,
@@ -528,6 +560,15 @@ func (i *CLI) signalHandler() {
 		case sig := <-signalChan:
 			switch sig {
 			case syscall.SIGINT:
+				if httpJobQueue := i.currentHTTPJobQueue(); i.Config.HTTPRequeueOnShutdown && httpJobQueue != nil {
+					i.logger.Warn("SIGINT received, requeueing running jobs and shutting down")
+					err := httpJobQueue.RequeueRunningJobs(i.ctx)
+					if err != nil {
+						i.logger.WithField("err", err).Error("couldn't requeue all running jobs")
+					}
+					i.cancel()
+					continue
+				}
 				i.logger.Warn("SIGINT received, starting graceful shutdown")
 				i.ProcessorPool.GracefulShutdown(false)
 			case syscall.SIGTERM:
@@ -567,12 +608,13 @@ func (i *CLI) logProcessorInfo(msg string) {
 		"total_processed": i.ProcessorPool.TotalProcessed(),
 	}).Info(msg)
 	i.ProcessorPool.Each(func(n int, proc *Processor) {
+		status, lastJobID, _ := proc.Status()
 		i.logger.WithFields(logrus.Fields{
 			"n":           n,
 			"id":          proc.ID,
 			"processed":   proc.ProcessedCount,
-			"status":      proc.CurrentStatus,
-			"last_job_id": proc.LastJobID,
+			"status":      status,
+			"last_job_id": lastJobID,
 		}).Info("processor info")
 	})
 }
@@ -601,6 +643,19 @@ func (i *CLI) setupJobQueueAndCanceller() error {
 			if err != nil {
 				return err
 			}
+			err = jobQueue.RecoverJobs(i.ctx)
+			if err != nil {
+				i.logger.WithField("err", err).Error("couldn't recover all jobs from state file")
+			}
+			// NOTE: an unreachable job-board isn't fatal at startup, as
+			// polling keeps retrying until it is reachable again.
+			err = jobQueue.Ping(i.ctx)
+			if err != nil {
+				i.logger.WithField("err", err).Warn("job-board health probe failed")
+			}
+			i.httpJobQueueMutex.Lock()
+			i.httpJobQueue = jobQueue
+			i.httpJobQueueMutex.Unlock()
 			subQueues = append(subQueues, jobQueue)
 		default:
 			return fmt.Errorf("unknown queue type %q", queueType)
@@ -693,11 +748,61 @@ func (i *CLI) buildHTTPJobQueue() (*HTTPJobQueue, error) {
 		return nil, errors.Wrap(err, "error parsing job board URL")
 	}
 
-	jobQueue, err := NewHTTPJobQueueWithIntervals(
-		jobBoardURL, i.Config.TravisSite,
-		i.Config.ProviderName, i.Config.QueueName,
-		i.Config.HTTPPollingInterval, i.Config.HTTPRefreshClaimInterval,
-		i.CancellationBroadcaster)
+	var prometheusRegisterer prometheus.Registerer
+	if i.Config.HTTPPrometheusMetrics {
+		prometheusRegisterer = prometheus.DefaultRegisterer
+	}
+
+	var resourceMonitor ResourceMonitor
+	if i.Config.HTTPLoadShedMinAvailableMemoryBytes > 0 || i.Config.HTTPLoadShedMaxLoadPercent > 0 {
+		resourceMonitor = NewSystemResourceMonitor(
+			int64(i.Config.HTTPLoadShedMinAvailableMemoryBytes),
+			float64(i.Config.HTTPLoadShedMaxLoadPercent)/100)
+	}
+
+	jobQueue, err := NewHTTPJobQueueWithConfig(&HTTPJobQueueConfig{
+		JobBoardURL:          jobBoardURL,
+		Site:                 i.Config.TravisSite,
+		ProviderName:         i.Config.ProviderName,
+		Infrastructure:       i.Config.Infra,
+		Queue:                i.Config.QueueName,
+		PollInterval:         i.Config.HTTPPollingInterval,
+		RefreshClaimInterval: i.Config.HTTPRefreshClaimInterval,
+		Provider:             i.BackendProvider,
+		RepositoryAllowList:  stringSplitComma(i.Config.HTTPRepositoryAllowList),
+		RepositoryDenyList:   stringSplitComma(i.Config.HTTPRepositoryDenyList),
+		RecordPath:           i.Config.HTTPRecordPath,
+		StatePath:            i.Config.HTTPStatePath,
+		HealthProbePath:      i.Config.HTTPHealthProbePath,
+		Processors:           i.ProcessorPool,
+		ResourceMonitor:      resourceMonitor,
+		ZeroCapacityMode:     i.Config.HTTPZeroCapacityMode,
+		PayloadStrictness:    i.Config.HTTPPayloadStrictness,
+		Sites:                stringSplitComma(i.Config.HTTPSites),
+		SiteStrategy:         i.Config.HTTPSiteStrategy,
+
+		MaxBufferedPayloadBytes:   int64(i.Config.HTTPMaxBufferedPayloadBytes),
+		MaxConcurrentProvisioning: i.Config.HTTPMaxConcurrentProvisioning,
+		PollTimeoutFactor:         i.Config.HTTPPollTimeoutFactor,
+		ReserveTimeout:            i.Config.HTTPReserveTimeout,
+		PollConcurrency:           i.Config.HTTPPollConcurrency,
+		MaxAdvertisedCapacity:     i.Config.HTTPMaxAdvertisedCapacity,
+		IdleGraceWindow:           i.Config.HTTPIdleGraceWindow,
+		MaxRetries:                i.Config.HTTPMaxRetries,
+		FetchFailureThreshold:     i.Config.HTTPFetchFailureThreshold,
+		DeadletterTTL:             i.Config.HTTPDeadletterTTL,
+		HeartbeatInterval:         i.Config.HTTPHeartbeatInterval,
+		PrefetchTTL:               i.Config.HTTPPrefetchTTL,
+		MaxUnsentAge:              i.Config.HTTPMaxUnsentAge,
+		QuietPeriodErrors:         i.Config.HTTPQuietPeriodErrors,
+		QuietPeriodWindow:         i.Config.HTTPQuietPeriodWindow,
+		QuietPeriodInterval:       i.Config.HTTPQuietPeriodInterval,
+		QuietPeriodDuration:       i.Config.HTTPQuietPeriodDuration,
+		ReportQueueDepth:          i.Config.HTTPReportQueueDepth,
+		RequireVMType:             i.Config.HTTPRequireVMType,
+		DelayFirstFetch:           i.Config.HTTPDelayFirstFetch,
+		PrometheusRegisterer:      prometheusRegisterer,
+	}, i.CancellationBroadcaster)
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating HTTP job queue")
 	}
@@ -0,0 +1,18 @@
+package worker
+
+import "time"
+
+// Clock is the source of time used by time-sensitive components such as the
+// HTTPJobQueue, so that tests can advance time synthetically rather than
+// waiting on the wall clock.
+type Clock interface {
+	Now() time.Time
+	Sleep(time.Duration)
+	After(time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -19,6 +19,7 @@ var (
 	defaultFilePollingInterval, _      = time.ParseDuration("5s")
 	defaultHTTPPollingInterval, _      = time.ParseDuration("3s")
 	defaultHTTPRefreshClaimInterval, _ = time.ParseDuration("5s")
+	defaultHTTPDeadletterTTL, _        = time.ParseDuration("15m")
 	defaultPoolSize                    = 1
 	defaultProviderName                = "docker"
 	defaultQueueType                   = "amqp"
@@ -106,6 +107,111 @@ var (
 			Value: defaultHTTPRefreshClaimInterval,
 			Usage: `Sleep interval between job claim refresh requests (only valid for "http" queue type)`,
 		}),
+		NewConfigDef("HTTPRepositoryAllowList", &cli.StringFlag{
+			Usage: `Comma-delimited list of repository slug patterns (e.g. "travis-ci/*") to exclusively run jobs for (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPRepositoryDenyList", &cli.StringFlag{
+			Usage: `Comma-delimited list of repository slug patterns (e.g. "travis-ci/*") to decline jobs for (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPRecordPath", &cli.StringFlag{
+			Usage: `Path to a file to record all job-board requests and responses to for debugging, with secrets redacted (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPMaxBufferedPayloadBytes", &cli.IntFlag{
+			Usage: `The memory budget in bytes for payloads of jobs fetched but not yet started, or 0 for no budget (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPMaxConcurrentProvisioning", &cli.IntFlag{
+			Usage: `The maximum number of jobs that may be provisioning at once, distinct from the pool size, or 0 for no limit (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPLoadShedMinAvailableMemoryBytes", &cli.IntFlag{
+			Usage: `The available memory in bytes below which no jobs are fetched, or 0 to not check memory (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPLoadShedMaxLoadPercent", &cli.IntFlag{
+			Usage: `The one-minute load average as a percentage of CPUs above which no jobs are fetched, or 0 to not check the load (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPIdleGraceWindow", &cli.DurationFlag{
+			Usage: `How long a processor must have been idle after finishing a job before it counts towards the capacity reported to job-board (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPMaxAdvertisedCapacity", &cli.IntFlag{
+			Usage: `The largest capacity reported to job-board regardless of the pool size, or 0 for no limit (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPPollConcurrency", &cli.IntFlag{
+			Value: 1,
+			Usage: `The number of goroutines taking turns polling job-board for each processor (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPPollTimeoutFactor", &cli.IntFlag{
+			Usage: `Multiple of the polling interval after which a job-board job ID request is aborted, or 0 for no timeout (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPReserveTimeout", &cli.DurationFlag{
+			Usage: `How long job-board may search for a job to reserve before responding to a job request, of at least 1s, or 0 to leave it to job-board (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPMaxRetries", &cli.IntFlag{
+			Usage: `The maximum number of times a job-board request is retried, in addition to the time spent retrying, or 0 for no limit (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPFetchFailureThreshold", &cli.IntFlag{
+			Value: 3,
+			Usage: `Number of consecutive failures to fetch a job after which it is deadlettered (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPDeadletterTTL", &cli.DurationFlag{
+			Value: defaultHTTPDeadletterTTL,
+			Usage: `How long a deadlettered job is handed back to job-board for whenever it is offered again (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPHeartbeatInterval", &cli.DurationFlag{
+			Usage: `Maximum interval at which the claims of running jobs are refreshed, where 0 uses the interval given by job-board (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPPrefetchTTL", &cli.DurationFlag{
+			Usage: `How long a job ID fetched ahead of the next poll may be used for, where 0 disables prefetching (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPQuietPeriodErrors", &cli.IntFlag{
+			Usage: `Number of job-board request errors within the quiet period window after which job-board is polled less often, or 0 for no quiet period (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPQuietPeriodWindow", &cli.DurationFlag{
+			Usage: `Window within which job-board request errors begin a quiet period, defaulting to 1m (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPQuietPeriodInterval", &cli.DurationFlag{
+			Usage: `Sleep interval between new job requests during a quiet period, defaulting to 30s (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPQuietPeriodDuration", &cli.DurationFlag{
+			Usage: `How long a quiet period lasts, defaulting to 5m (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPMaxUnsentAge", &cli.DurationFlag{
+			Usage: `How long after fetching its ID a job not yet sent to a processor is handed back to job-board, or 0 for no limit (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPHealthProbePath", &cli.StringFlag{
+			Usage: `Job-board path requested to check that job-board is reachable at startup, defaulting to "/jobs" (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPStatePath", &cli.StringFlag{
+			Usage: `Path to a file to persist dispatched jobs to, including their job-board bearer tokens, so that they are handed back to job-board after a crash (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPDelayFirstFetch", &cli.BoolFlag{
+			Usage: `Whether to delay requesting the first job for a processor until it has joined the pool (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPRequireVMType", &cli.BoolFlag{
+			Usage: `Whether to decline jobs without a VM type rather than run them with the default VM type (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPReportQueueDepth", &cli.BoolFlag{
+			Usage: `Whether to report the number of jobs fetched but not yet started to job-board when requesting jobs (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPRequeueOnShutdown", &cli.BoolFlag{
+			Usage: `Whether to hand running jobs back to job-board on graceful shutdown, rather than letting them finish (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPPrometheusMetrics", &cli.BoolFlag{
+			Usage: `Whether to also expose job queue metrics for Prometheus at /metrics on the remote controller, which requires remote-controller-auth (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPSites", &cli.StringFlag{
+			Usage: `Comma-delimited list of sites to poll job-board for, where job-board serves more than one, defaulting to the Travis site (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPSiteStrategy", &cli.StringFlag{
+			Value: "priority",
+			Usage: `Whether to poll sites in "priority" order, or take turns with "round-robin" (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPPayloadStrictness", &cli.StringFlag{
+			Value: "lenient",
+			Usage: `Whether job payload fields unknown to worker are ignored with "lenient", logged with "warn", or cause the job to be declined with "error" (only valid for "http" queue type)`,
+		}),
+		NewConfigDef("HTTPZeroCapacityMode", &cli.StringFlag{
+			Value: "poll",
+			Usage: `Whether to still "poll" job-board at zero capacity, marked as full, or "skip" polling (only valid for "http" queue type)`,
+		}),
 		NewConfigDef("LibratoEmail", &cli.StringFlag{
 			Usage: "Librato metrics account email",
 		}),
@@ -394,6 +500,42 @@ type Config struct {
 	HTTPPollingInterval      time.Duration `config:"http-polling-interval"`
 	HTTPRefreshClaimInterval time.Duration `config:"http-refresh-claim-interval"`
 
+	HTTPRepositoryAllowList string `config:"http-repository-allow-list"`
+	HTTPRepositoryDenyList  string `config:"http-repository-deny-list"`
+	HTTPRecordPath          string `config:"http-record-path"`
+	HTTPStatePath           string `config:"http-state-path"`
+	HTTPHealthProbePath     string `config:"http-health-probe-path"`
+	HTTPZeroCapacityMode    string `config:"http-zero-capacity-mode"`
+	HTTPPayloadStrictness   string `config:"http-payload-strictness"`
+	HTTPSites               string `config:"http-sites"`
+	HTTPSiteStrategy        string `config:"http-site-strategy"`
+
+	HTTPMaxBufferedPayloadBytes   int           `config:"http-max-buffered-payload-bytes"`
+	HTTPMaxConcurrentProvisioning int           `config:"http-max-concurrent-provisioning"`
+	HTTPPollTimeoutFactor         int           `config:"http-poll-timeout-factor"`
+	HTTPPollConcurrency           int           `config:"http-poll-concurrency"`
+	HTTPMaxAdvertisedCapacity     int           `config:"http-max-advertised-capacity"`
+	HTTPMaxRetries                int           `config:"http-max-retries"`
+	HTTPFetchFailureThreshold     int           `config:"http-fetch-failure-threshold"`
+	HTTPDeadletterTTL             time.Duration `config:"http-deadletter-ttl"`
+	HTTPHeartbeatInterval         time.Duration `config:"http-heartbeat-interval"`
+	HTTPPrefetchTTL               time.Duration `config:"http-prefetch-ttl"`
+	HTTPReserveTimeout            time.Duration `config:"http-reserve-timeout"`
+	HTTPMaxUnsentAge              time.Duration `config:"http-max-unsent-age"`
+	HTTPIdleGraceWindow           time.Duration `config:"http-idle-grace-window"`
+	HTTPQuietPeriodErrors         int           `config:"http-quiet-period-errors"`
+	HTTPQuietPeriodWindow         time.Duration `config:"http-quiet-period-window"`
+	HTTPQuietPeriodInterval       time.Duration `config:"http-quiet-period-interval"`
+	HTTPQuietPeriodDuration       time.Duration `config:"http-quiet-period-duration"`
+	HTTPPrometheusMetrics         bool          `config:"http-prometheus-metrics"`
+	HTTPRequeueOnShutdown         bool          `config:"http-requeue-on-shutdown"`
+	HTTPReportQueueDepth          bool          `config:"http-report-queue-depth"`
+	HTTPRequireVMType             bool          `config:"http-require-vm-type"`
+	HTTPDelayFirstFetch           bool          `config:"http-delay-first-fetch"`
+
+	HTTPLoadShedMinAvailableMemoryBytes int `config:"http-load-shed-min-available-memory-bytes"`
+	HTTPLoadShedMaxLoadPercent          int `config:"http-load-shed-max-load-percent"`
+
 	HardTimeout         time.Duration `config:"hard-timeout"`
 	InitialSleep        time.Duration `config:"initial-sleep"`
 	LogTimeout          time.Duration `config:"log-timeout"`
@@ -1,19 +1,17 @@
 package worker
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	gocontext "context"
 
-	"github.com/bitly/go-simplejson"
 	"github.com/sirupsen/logrus"
-	"github.com/travis-ci/worker/backend"
 	"github.com/travis-ci/worker/context"
 )
 
@@ -23,6 +21,9 @@ type FileJobQueue struct {
 	pollingInterval time.Duration
 
 	buildJobChan chan Job
+	pollOnce     sync.Once
+	ctx          gocontext.Context
+	cancel       gocontext.CancelFunc
 
 	baseDir     string
 	createdDir  string
@@ -61,9 +62,13 @@ func NewFileJobQueue(baseDir, queue string, pollingInterval time.Duration) (*Fil
 		}
 	}
 
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+
 	return &FileJobQueue{
 		queue:           queue,
 		pollingInterval: pollingInterval,
+		ctx:             ctx,
+		cancel:          cancel,
 
 		baseDir:     baseDir,
 		createdDir:  createdDir,
@@ -74,19 +79,55 @@ func NewFileJobQueue(baseDir, queue string, pollingInterval time.Duration) (*Fil
 	}, nil
 }
 
-// Jobs returns a channel of jobs from the created directory
+// Jobs returns a channel of jobs from the created directory, which is closed
+// once the given context is done.  The directory is polled once for every
+// caller until Cleanup is called, so that one processor stopping doesn't stop
+// jobs from reaching the others.
 func (f *FileJobQueue) Jobs(ctx gocontext.Context) (<-chan Job, error) {
-	if f.buildJobChan == nil {
+	f.pollOnce.Do(func() {
 		f.buildJobChan = make(chan Job)
-		go f.pollInDirForJobs(ctx)
-	}
-	return f.buildJobChan, nil
+		go f.pollInDirForJobs(f.ctx)
+	})
+
+	callerJobChan := make(chan Job)
+	go func() {
+		defer close(callerJobChan)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case buildJob, ok := <-f.buildJobChan:
+				if !ok {
+					return
+				}
+
+				select {
+				case callerJobChan <- buildJob:
+				case <-ctx.Done():
+					// NOTE: the job's file is only moved out of the created
+					// directory once received, so it is offered again on the
+					// next poll.
+					return
+				}
+			}
+		}
+	}()
+
+	return callerJobChan, nil
 }
 
 func (f *FileJobQueue) pollInDirForJobs(ctx gocontext.Context) {
+	defer close(f.buildJobChan)
+
 	for {
 		f.pollInDirTick(ctx)
-		time.Sleep(f.pollingInterval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(f.pollingInterval):
+		}
 	}
 }
 
@@ -109,11 +150,8 @@ func (f *FileJobQueue) pollInDirTick(ctx gocontext.Context) {
 		}
 
 		buildJob := &fileJob{
-			createdFile:     filepath.Join(f.createdDir, entry.Name()),
-			payload:         &JobPayload{},
-			startAttributes: &backend.StartAttributes{},
+			createdFile: filepath.Join(f.createdDir, entry.Name()),
 		}
-		startAttrs := &jobPayloadStartAttrs{Config: &backend.StartAttributes{}}
 
 		fb, err := ioutil.ReadFile(buildJob.createdFile)
 		if err != nil {
@@ -121,35 +159,24 @@ func (f *FileJobQueue) pollInDirTick(ctx gocontext.Context) {
 			continue
 		}
 
-		err = json.Unmarshal(fb, buildJob.payload)
-		if err != nil {
-			logger.WithField("err", err).Error("payload JSON parse error, skipping")
-			continue
-		}
-
-		err = json.Unmarshal(fb, &startAttrs)
-		if err != nil {
-			logger.WithField("err", err).Error("start attributes JSON parse error, skipping")
-			continue
-		}
-
-		buildJob.rawPayload, err = simplejson.NewJson(fb)
+		buildJob.payload, buildJob.startAttributes, buildJob.rawPayload, err = parseJobPayload(
+			fb, f.DefaultLanguage, f.DefaultDist, f.DefaultGroup, f.DefaultOS)
 		if err != nil {
-			logger.WithField("err", err).Error("raw payload JSON parse error, skipping")
+			logger.WithField("err", err).Error("payload parse error, skipping")
 			continue
 		}
 
-		buildJob.startAttributes = startAttrs.Config
-		buildJob.startAttributes.VMConfig = buildJob.payload.VMConfig
-		buildJob.startAttributes.VMType = buildJob.payload.VMType
-		buildJob.startAttributes.SetDefaults(f.DefaultLanguage, f.DefaultDist, f.DefaultGroup, f.DefaultOS, VMTypeDefault, VMConfigDefault)
 		buildJob.receivedFile = filepath.Join(f.receivedDir, entry.Name())
 		buildJob.startedFile = filepath.Join(f.startedDir, entry.Name())
 		buildJob.finishedFile = filepath.Join(f.finishedDir, entry.Name())
 		buildJob.logFile = filepath.Join(f.logDir, strings.Replace(entry.Name(), ".json", ".log", -1))
 		buildJob.bytes = fb
 
-		f.buildJobChan <- buildJob
+		select {
+		case f.buildJobChan <- buildJob:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
@@ -158,7 +185,9 @@ func (q *FileJobQueue) Name() string {
 	return "file"
 }
 
-// Cleanup is a no-op
+// Cleanup stops polling the created directory, closing the channels of all
+// callers of Jobs.
 func (f *FileJobQueue) Cleanup() error {
+	f.cancel()
 	return nil
 }
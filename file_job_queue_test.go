@@ -0,0 +1,50 @@
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	gocontext "context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileJobQueue_Jobs_PerCaller(t *testing.T) {
+	dir, err := ioutil.TempDir("", "travis-worker")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fjq, err := NewFileJobQueue(dir, "test", time.Millisecond)
+	assert.Nil(t, err)
+
+	ctx1, cancel1 := gocontext.WithCancel(gocontext.TODO())
+	jobs1, err := fjq.Jobs(ctx1)
+	assert.Nil(t, err)
+
+	jobs2, err := fjq.Jobs(gocontext.TODO())
+	assert.Nil(t, err)
+
+	cancel1()
+	select {
+	case _, ok := <-jobs1:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel of the cancelled caller wasn't closed")
+	}
+
+	select {
+	case <-jobs2:
+		t.Fatal("channel of the other caller was closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Nil(t, fjq.Cleanup())
+	select {
+	case _, ok := <-jobs2:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel wasn't closed on cleanup")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	gocontext "context"
@@ -29,7 +31,19 @@ type httpJob struct {
 	requeued        bool
 	stateCount      uint
 
+	// handedBack is set once the job has been handed back to job-board by
+	// its queue, after which no further state updates are sent for it.
+	handedBack int32
+
+	// mutex serializes changes to the state of the job along with the state
+	// updates sent for them, as the job may be handed back by its queue
+	// while its processor is running it.
+	mutex sync.Mutex
+
 	refreshClaim func(gocontext.Context)
+	acknowledge  func(gocontext.Context)
+	provisioned  func(gocontext.Context)
+	requeuedSelf func(gocontext.Context)
 	deleteSelf   func(gocontext.Context) error
 	cancelSelf   func(gocontext.Context)
 }
@@ -67,10 +81,16 @@ func (j *httpJob) StartAttributes() *backend.StartAttributes {
 }
 
 func (j *httpJob) FinishState() FinishState {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
 	return j.finishState
 }
 
 func (j *httpJob) Requeued() bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
 	return j.requeued
 }
 
@@ -89,20 +109,55 @@ func (j *httpJob) Error(ctx gocontext.Context, errMessage string) error {
 }
 
 func (j *httpJob) Requeue(ctx gocontext.Context) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.requeue(ctx, false)
+}
+
+// requeue marks the job as requeued and sends the state update for it, even
+// if the job has already been handed back when force is true.  The mutex
+// must be held by the caller.
+func (j *httpJob) requeue(ctx gocontext.Context, force bool) error {
 	context.LoggerFromContext(ctx).WithField("self", "http_job").Info("requeueing job")
 
 	metrics.Mark("worker.job.requeue")
 
 	j.requeued = true
+	if j.provisioned != nil {
+		j.provisioned(ctx)
+	}
+	if j.requeuedSelf != nil {
+		j.requeuedSelf(ctx)
+	}
 
+	curState := j.currentState()
 	j.received = time.Time{}
 	j.started = time.Time{}
 
-	return j.sendStateUpdate(ctx, j.currentState(), "created")
+	if force {
+		return j.postStateUpdate(ctx, curState, "created")
+	}
+	return j.sendStateUpdate(ctx, curState, "created")
+}
+
+// requeueHandedBack requeues a job that has been handed back, which is the
+// only state update still sent for it.
+func (j *httpJob) requeueHandedBack(ctx gocontext.Context) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.requeue(ctx, true)
 }
 
 func (j *httpJob) Received(ctx gocontext.Context) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
 	j.received = time.Now()
+	if j.acknowledge != nil {
+		j.acknowledge(ctx)
+	}
 	if j.refreshClaim != nil {
 		context.LoggerFromContext(ctx).WithField("self", "http_job").Debug("starting claim refresh goroutine")
 		go j.refreshClaim(context.FromJWT(ctx, j.payload.JWT))
@@ -111,7 +166,13 @@ func (j *httpJob) Received(ctx gocontext.Context) error {
 }
 
 func (j *httpJob) Started(ctx gocontext.Context) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
 	j.started = time.Now()
+	if j.provisioned != nil {
+		j.provisioned(ctx)
+	}
 
 	metrics.TimeSince("travis.worker.job.start_time", j.received)
 
@@ -133,6 +194,16 @@ func (j *httpJob) currentState() string {
 }
 
 func (j *httpJob) Finish(ctx gocontext.Context, state FinishState) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.provisioned != nil {
+		j.provisioned(ctx)
+	}
+	if j.isHandedBack() {
+		return nil
+	}
+
 	err := j.deleteSelf(ctx)
 	if err != nil {
 		return err
@@ -203,7 +274,30 @@ func (j *httpJob) createStateUpdateBody(curState, newState string) map[string]in
 	return body
 }
 
+// handBack marks the job as handed back to job-board, after which no further
+// state updates are sent for it.  Taking the mutex waits for any state update
+// already being sent to complete.
+func (j *httpJob) handBack() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	atomic.StoreInt32(&j.handedBack, 1)
+}
+
+func (j *httpJob) isHandedBack() bool {
+	return atomic.LoadInt32(&j.handedBack) == 1
+}
+
 func (j *httpJob) sendStateUpdate(ctx gocontext.Context, curState, newState string) error {
+	if j.isHandedBack() {
+		context.LoggerFromContext(ctx).WithField("self", "http_job").WithField("state", newState).Debug("skipping state update for job handed back to job-board")
+		return nil
+	}
+
+	return j.postStateUpdate(ctx, curState, newState)
+}
+
+func (j *httpJob) postStateUpdate(ctx gocontext.Context, curState, newState string) error {
 	j.stateCount++
 	payload := j.createStateUpdateBody(curState, newState)
 
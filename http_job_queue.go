@@ -1,43 +1,286 @@
 package worker
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/bitly/go-simplejson"
 	"github.com/cenk/backoff"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/travis-ci/worker/backend"
 	"github.com/travis-ci/worker/context"
 	"github.com/travis-ci/worker/metrics"
+	"go.opencensus.io/trace"
 
 	gocontext "context"
 )
 
+const (
+	// HTTPZeroCapacityModePoll polls job-board even at zero capacity, marking
+	// the request as full so that the worker remains visible.
+	HTTPZeroCapacityModePoll = "poll"
+
+	// HTTPZeroCapacityModeSkip skips polling job-board at zero capacity.
+	HTTPZeroCapacityModeSkip = "skip"
+
+	// HTTPPayloadStrictnessLenient ignores payload fields unknown to worker.
+	HTTPPayloadStrictnessLenient = "lenient"
+
+	// HTTPPayloadStrictnessWarn logs a warning for payloads with fields
+	// unknown to worker, and runs the job anyway.
+	HTTPPayloadStrictnessWarn = "warn"
+
+	// HTTPPayloadStrictnessError declines jobs with payloads with fields
+	// unknown to worker, handing them back to job-board.
+	HTTPPayloadStrictnessError = "error"
+
+	// HTTPSiteStrategyPriority polls each site in the configured order on
+	// every poll, taking a job from the first site that has one.
+	HTTPSiteStrategyPriority = "priority"
+
+	// HTTPSiteStrategyRoundRobin polls each site in turn, starting each poll
+	// with the site after the one the previous poll started with.
+	HTTPSiteStrategyRoundRobin = "round-robin"
+
+	// HTTPPollModeNormal polls job-board at the poll interval.
+	HTTPPollModeNormal = "normal"
+
+	// HTTPPollModeRecovery polls job-board at the quiet period interval, after
+	// a burst of errors.
+	HTTPPollModeRecovery = "recovery"
+)
+
+// DeclineReason is why a fetched job was handed back to job-board without
+// being run, which is reported as a dimension of the "declined" metric.
+type DeclineReason string
+
+const (
+	// DeclineReasonRepositoryNotPermitted is a job for a repository that is
+	// denied, or not allowed, by the configured repository lists.
+	DeclineReasonRepositoryNotPermitted DeclineReason = "repository_not_permitted"
+
+	// DeclineReasonUnsupportedVMType is a job for a VM type that neither the
+	// provider nor the processors support.
+	DeclineReasonUnsupportedVMType DeclineReason = "unsupported_vm_type"
+
+	// DeclineReasonMissingVMType is a job without a VM type, when an explicit
+	// VM type is required.
+	DeclineReasonMissingVMType DeclineReason = "missing_vm_type"
+
+	// DeclineReasonUnknownPayloadFields is a job with payload fields unknown
+	// to worker, when HTTPPayloadStrictnessError is used.
+	DeclineReasonUnknownPayloadFields DeclineReason = "unknown_payload_fields"
+)
+
+// httpJobQueueMaxDrops is the number of recent drops kept for the status.
+const httpJobQueueMaxDrops = 50
+
 var (
 	httpJobQueueNoJobsErr  = fmt.Errorf("no jobs available")
 	httpJobRefreshClaimErr = fmt.Errorf("failed to refresh claim")
+	httpJobDeclinedErr     = fmt.Errorf("job declined")
 )
 
 // HTTPJobQueue is a JobQueue that uses http
 type HTTPJobQueue struct {
 	jobBoardURL          *url.URL
+	urlResolver          func(gocontext.Context) (*url.URL, error)
 	site                 string
+	sites                []string
+	siteStrategy         string
 	providerName         string
+	infrastructure       string
 	queue                string
 	pollInterval         time.Duration
+	pollTimeoutFactor    int
+	reserveTimeout       time.Duration
 	refreshClaimInterval time.Duration
+	retryMaxInterval     time.Duration
+	retryMaxElapsedTime  time.Duration
+	maxRetries           int
+	provider             backend.Provider
+	repositoryAllowList  []string
+	repositoryDenyList   []string
+	requireVMType        bool
+	processorsMutex      sync.RWMutex
+	processors           ProcessorEacherSizer
+	resourceMonitor      ResourceMonitor
+	zeroCapacityMode     string
+	payloadStrictness    string
+	reportQueueDepth     bool
+	httpClient           *http.Client
+	recorder             *httpRecorder
+	prometheus           *httpJobQueuePrometheusMetrics
+	clock                Clock
 	cb                   *CancellationBroadcaster
 
+	unackedJobsMutex        sync.Mutex
+	unackedJobs             map[uint64]*httpUnackedJob
+	unackedPayloadBytes     int64
+	maxBufferedPayloadBytes int64
+
+	statusMutex    sync.Mutex
+	lastPollAt     time.Time
+	lastErr        error
+	lastErrAt      time.Time
+	jobsFetched    uint64
+	jobsDispatched uint64
+
+	quietPeriodErrors   int
+	quietPeriodWindow   time.Duration
+	quietPeriodInterval time.Duration
+	quietPeriodDuration time.Duration
+	recentErrors        []time.Time
+	recoveryUntil       time.Time
+	currentPollInterval time.Duration
+	loadShedding        bool
+	drops               []HTTPJobQueueDrop
+	nextDrop            int
+
+	sitesMutex sync.Mutex
+	nextSite   int
+	jobSites   map[uint64]string
+
+	dispatchedJobsMutex sync.Mutex
+	dispatchedJobs      map[uint64]*httpJob
+
+	maxAdvertisedCapacity int
+	capacityClamped       bool
+	idleGraceWindow       time.Duration
+
+	pollConcurrency int
+	delayFirstFetch bool
+	inFlightMutex   sync.Mutex
+	inFlightJobs    map[uint64]struct{}
+
+	maxConcurrentProvisioning int
+	provisioningMutex         sync.Mutex
+	provisioningReserved      int
+	provisioningJobs          map[uint64]time.Time
+
+	fetchFailureThreshold int
+	deadletterTTL         time.Duration
+	fetchFailuresMutex    sync.Mutex
+	fetchFailures         map[uint64]*httpFetchFailure
+	deadletteredJobs      map[uint64]time.Time
+
+	heartbeatInterval time.Duration
+
+	// NOTE: done is closed by Cleanup, which then waits on pollers for every
+	// goroutine started by the queue to exit.  lifecycleMutex guards against
+	// adding to pollers once Cleanup has started waiting.
+	lifecycleMutex sync.Mutex
+	done           chan struct{}
+	pollers        sync.WaitGroup
+
+	statePath     string
+	stateMutex    sync.Mutex
+	recoveredJobs []httpJobQueueStateJob
+
+	prefetchTTL     time.Duration
+	maxUnsentAge    time.Duration
+	healthProbePath string
+
+	// NOTE: prefetched job IDs are kept per caller of Jobs, keyed by the
+	// context its pollers poll with, so that a job ID is only ever used by
+	// the processor it was fetched for.
+	prefetchMutex    sync.Mutex
+	prefetching      map[gocontext.Context]bool
+	prefetchedJobIDs map[gocontext.Context]*httpPrefetchedJobID
+
 	DefaultLanguage, DefaultDist, DefaultGroup, DefaultOS string
 }
 
+// HTTPJobQueueStatus is a snapshot of the observable state of an
+// HTTPJobQueue, suitable for serving as JSON.
+type HTTPJobQueueStatus struct {
+	LastPollAt     time.Time `json:"lastPollAt"`
+	LastError      string    `json:"lastError,omitempty"`
+	LastErrorAt    time.Time `json:"lastErrorAt"`
+	JobsFetched    uint64    `json:"jobsFetched"`
+	JobsDispatched uint64    `json:"jobsDispatched"`
+	PollMode       string    `json:"pollMode"`
+	PollInterval   string    `json:"pollInterval"`
+	LoadShedding   bool      `json:"loadShedding"`
+
+	Capacity    int     `json:"capacity"`
+	PoolSize    int     `json:"poolSize"`
+	Utilization float64 `json:"utilization"`
+
+	Unacked              int      `json:"unacked"`
+	BufferedPayloadBytes int64    `json:"bufferedPayloadBytes"`
+	Provisioning         int      `json:"provisioning"`
+	Deadlettered         int      `json:"deadlettered"`
+	RunningJobIDs        []uint64 `json:"runningJobIDs"`
+
+	RecentDrops []HTTPJobQueueDrop `json:"recentDrops"`
+}
+
+// HTTPJobQueueDrop is a job that was fetched from job-board but not run, such
+// as a declined job or one whose processor went away before starting it.
+type HTTPJobQueueDrop struct {
+	JobID  uint64    `json:"jobID"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// httpUnackedJob is a job that has been fetched from job-board but not yet
+// acknowledged as started by a processor, along with its payload size.
+type httpUnackedJob struct {
+	fetchedAt    time.Time
+	payloadBytes int64
+}
+
+// httpPrefetchedJobID is a job ID fetched ahead of time, along with the poll
+// interval job-board returned with it and the context of the poller that
+// fetched it.
+type httpPrefetchedJobID struct {
+	ctx          gocontext.Context
+	jobID        uint64
+	pollInterval time.Duration
+	fetchedAt    time.Time
+}
+
+// httpFetchFailure is the number of consecutive failures to fetch a job,
+// along with when it last failed.
+type httpFetchFailure struct {
+	count  int
+	lastAt time.Time
+}
+
+// httpDispatchStats is the breakdown of the cost of dispatching a single job,
+// which is logged in one line once the job has been sent to a processor.
+type httpDispatchStats struct {
+	fetchJobIDDuration time.Duration
+	fetchJobDuration   time.Duration
+	fetchJobRetries    int
+	payloadBytes       int
+	blockingDuration   time.Duration
+}
+
+func (s *httpDispatchStats) fields() logrus.Fields {
+	return logrus.Fields{
+		"fetch_job_id_duration_ms": s.fetchJobIDDuration.Seconds() * 1e3,
+		"fetch_job_duration_ms":    s.fetchJobDuration.Seconds() * 1e3,
+		"fetch_job_retries":        s.fetchJobRetries,
+		"payload_bytes":            s.payloadBytes,
+		"send_duration_ms":         s.blockingDuration.Seconds() * 1e3,
+	}
+}
+
 type httpFetchJobsRequest struct {
 	Jobs []string `json:"jobs"`
 }
@@ -52,36 +295,473 @@ type jobBoardErrorResponse struct {
 	UpstreamError string `json:"upstream_error,omitempty"`
 }
 
-// NewHTTPJobQueue creates a new http job queue
-func NewHTTPJobQueue(jobBoardURL *url.URL, site, providerName, queue string,
+// ProcessorEacherSizer is the view of a processor pool used by the
+// HTTPJobQueue to determine its capacity.
+type ProcessorEacherSizer interface {
+	Each(func(int, *Processor))
+	Size() int
+}
+
+// isNilProcessors reports whether processors is nil, including a nil pointer
+// wrapped in the interface such as a *ProcessorPool that hasn't been created
+// yet, which would otherwise panic on the first poll.
+func isNilProcessors(processors ProcessorEacherSizer) bool {
+	if processors == nil {
+		return true
+	}
+	v := reflect.ValueOf(processors)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+// HTTPJobQueueConfig contains every tunable of an HTTPJobQueue.  Any zero
+// value is replaced with the documented default when the queue is created.
+type HTTPJobQueueConfig struct {
+	JobBoardURL  *url.URL
+	Site         string
+	ProviderName string
+	Queue        string
+
+	// Sites are the sites polled for jobs when job-board serves more than
+	// one, each of which is sent as the Travis-Site header of requests for
+	// its jobs.  Defaults to Site, and Site defaults to the first of Sites.
+	Sites []string
+
+	// SiteStrategy determines the order in which Sites are polled, and is
+	// one of HTTPSiteStrategyPriority or HTTPSiteStrategyRoundRobin.
+	// Defaults to HTTPSiteStrategyPriority.
+	SiteStrategy string
+
+	// Infrastructure is sent to job-board as the Travis-Infrastructure
+	// header.  Defaults to ProviderName.
+	Infrastructure string
+
+	// PollInterval is the sleep between job requests, unless job-board
+	// responds with a Travis-Pop-Interval header.  Defaults to 3s.
+	PollInterval time.Duration
+
+	// PollTimeoutFactor bounds each job ID request to PollInterval times the
+	// factor, so that a slow job-board doesn't hold up polling.  Job ID
+	// requests are only bounded by the context when 0.
+	PollTimeoutFactor int
+
+	// ReserveTimeout is sent to job-board as the reserve_timeout of job ID
+	// requests, in whole seconds, to tell it how long to search for a job
+	// to reserve before responding that there is none.  It must be at least
+	// 1s, and shorter than the job ID request timeout given by
+	// PollTimeoutFactor, if any.  Not sent when 0.
+	ReserveTimeout time.Duration
+
+	// RefreshClaimInterval is the sleep between job claim refresh requests,
+	// unless job-board responds with a Travis-Refresh-Claim-Interval header.
+	// Defaults to 5s.
+	RefreshClaimInterval time.Duration
+
+	// RetryMaxInterval is the maximum backoff interval between retried
+	// job-board requests.  Defaults to 10s.
+	RetryMaxInterval time.Duration
+
+	// RetryMaxElapsedTime is the maximum total time spent retrying a
+	// job-board request.  Defaults to 1m.
+	RetryMaxElapsedTime time.Duration
+
+	// MaxRetries is the maximum number of times a job-board request is
+	// retried, in addition to RetryMaxElapsedTime.  Requests are only
+	// bounded by RetryMaxElapsedTime when 0.
+	MaxRetries int
+
+	// Provider is consulted for VM type support before a fetched job is
+	// dispatched.  Jobs with an unsupported VM type are declined.  No check
+	// is done when nil.
+	Provider backend.Provider
+
+	// RepositoryAllowList and RepositoryDenyList contain repository slug
+	// patterns as accepted by path.Match, e.g. "travis-ci/*".  Jobs for a
+	// repository matching the deny list, or not matching a non-empty allow
+	// list, are declined.  Malformed patterns are rejected when the queue is
+	// created, rather than silently matching nothing.
+	RepositoryAllowList []string
+	RepositoryDenyList  []string
+
+	// RecordPath is the path of a file to which every job-board request and
+	// response is recorded for debugging, with credentials and secrets
+	// redacted.  Nothing is recorded when empty.
+	RecordPath string
+
+	// RecordMaxBytes is the size at which the record file is rotated.
+	// Defaults to 10MiB.
+	RecordMaxBytes int64
+
+	// Processors is the pool whose ready processors are reported to
+	// job-board as the worker's capacity, alongside the pool size.  No
+	// capacity is reported when nil.  A nil pointer, such as a *ProcessorPool
+	// that hasn't been created yet, is rejected.
+	Processors ProcessorEacherSizer
+
+	// URLResolver, when set, supplies the job-board URL for each request,
+	// overriding JobBoardURL, e.g. where job-board is sharded by queue or
+	// discovered dynamically.  It must resolve requests about a given job,
+	// such as claim refreshes, to the job-board the job was fetched from.
+	// JobBoardURL remains the one the state file is associated with.
+	URLResolver func(gocontext.Context) (*url.URL, error)
+
+	// IdleGraceWindow is how long a processor must have been waiting since
+	// finishing its last job before it counts as ready for another, so that
+	// no job is fetched for it while it may still be tearing down the last
+	// one's instance.  As processors record when they finished their last
+	// job with the wall clock, the window is always measured with the wall
+	// clock rather than Clock.  Processors are ready as soon as they are
+	// waiting when 0.
+	IdleGraceWindow time.Duration
+
+	// MaxAdvertisedCapacity is the largest capacity sent to job-board, as a
+	// safety valve against a misconfigured pool causing job-board to reserve
+	// an unreasonable number of jobs.  The capacity isn't capped when 0.
+	MaxAdvertisedCapacity int
+
+	// DelayFirstFetch delays the first fetch of each caller of Jobs until the
+	// processor that called it, as identified by its context, has joined
+	// Processors, i.e. until it is about to receive from the jobs channel.
+	// Processors create their jobs channel before joining the pool, so that
+	// otherwise the first job may be claimed, and its send block, before
+	// anyone receives it.  Callers that aren't processors, or queues without
+	// Processors, aren't delayed.  Once the first job has been sent, polling
+	// waits on its ready channel as usual.
+	DelayFirstFetch bool
+
+	// PollConcurrency is the number of goroutines polling job-board for each
+	// caller of Jobs, all of which send to the same channel.  They take turns,
+	// so that job-board is polled up to that many times per poll interval,
+	// but a job is only ever claimed while the caller is ready to receive it.
+	// A job ID being fetched by one of them is skipped by the others.
+	// Defaults to 1.
+	PollConcurrency int
+
+	// ResourceMonitor enables load shedding: it is checked before every poll,
+	// and no jobs are fetched while it reports the host to be under resource
+	// pressure, during which the capacity is reported as zero.  No load is
+	// shed when nil.
+	ResourceMonitor ResourceMonitor
+
+	// MaxBufferedPayloadBytes is the memory budget for the payloads of jobs
+	// that have been fetched but not yet acknowledged by a processor.  No
+	// jobs are fetched while the budget is exceeded.  No budget is applied
+	// when 0.
+	MaxBufferedPayloadBytes int64
+
+	// MaxConcurrentProvisioning is the maximum number of jobs that may be
+	// provisioning at once, i.e. dispatched but not yet started, failed or
+	// requeued.  No jobs are fetched while the limit is reached, even if
+	// processors are idle.  No limit is applied when 0.
+	MaxConcurrentProvisioning int
+
+	// FetchFailureThreshold is the number of consecutive failures to fetch a
+	// job after which the job is deadlettered: its reservation is deleted so
+	// that job-board may offer it to another worker, and it is handed back
+	// whenever job-board offers it to this worker again within DeadletterTTL.
+	// Defaults to 3.
+	FetchFailureThreshold int
+
+	// DeadletterTTL is how long a deadlettered job is skipped for.  Defaults
+	// to 15m.
+	DeadletterTTL time.Duration
+
+	// RequireVMType enables declining jobs whose payload has no VM type,
+	// rather than running them with the default VM type, for queues where a
+	// missing VM type indicates a malformed job.
+	RequireVMType bool
+
+	// ReportQueueDepth enables sending the number of jobs fetched but not
+	// yet started by a processor to job-board as the Travis-Queue-Depth
+	// header of job requests, so that these may be accounted for when
+	// dispatching jobs.
+	ReportQueueDepth bool
+
+	// StatePath is the path of a file to which the jobs dispatched by the
+	// queue are persisted whenever they change, so that they may be handed
+	// back to job-board by RecoverJobs after a restart.  The file contains the
+	// JWTs of the jobs, which are bearer tokens for job-board, and is written
+	// with 0600 permissions.  Nothing is persisted when empty.
+	StatePath string
+
+	// HeartbeatInterval enables refreshing the claims of running jobs at least
+	// as often as the given interval, rather than only at the interval given
+	// by job-board, so that job-board doesn't expire the claims of long
+	// running jobs.  A job's claim is no longer refreshed once it has
+	// finished.  Only the interval given by job-board is used when 0.
+	HeartbeatInterval time.Duration
+
+	// PrefetchTTL enables fetching the next job ID while a dispatched job is
+	// starting, so that the next poll may skip fetching one.  A prefetched job
+	// ID is only used by the caller of Jobs it was fetched for, and is
+	// discarded once it is older than PrefetchTTL, or once the context of the
+	// poller that fetched it is done.  No job IDs are prefetched when
+	// 0.
+	PrefetchTTL time.Duration
+
+	// MaxUnsentAge is the age after which a fetched job that hasn't yet been
+	// sent to a processor is handed back to job-board rather than sent, as
+	// job-board may have given it to another worker by then.  The age counts
+	// from when the job ID was fetched, so it includes the time a prefetched
+	// job ID was kept for, as well as the time spent waiting for a processor
+	// to receive the job.  Jobs are sent regardless of their age when 0.
+	MaxUnsentAge time.Duration
+
+	// HealthProbePath is the job-board path requested with HEAD by Ping to
+	// check that job-board is reachable, for job-boards that serve health
+	// checks at a dedicated path such as /healthz.  It must be an absolute
+	// path without a query or fragment.  Defaults to /jobs.
+	HealthProbePath string
+
+	// QuietPeriodErrors enables a quiet period after a burst of errors: once
+	// this many requests to job-board have failed within QuietPeriodWindow,
+	// job-board is polled at QuietPeriodInterval rather than the poll
+	// interval for QuietPeriodDuration, so that a flapping job-board isn't
+	// hit at the full rate while recovering.  No quiet period is applied when
+	// 0.
+	QuietPeriodErrors int
+
+	// QuietPeriodWindow is the window within which QuietPeriodErrors errors
+	// begin a quiet period.  Defaults to 1m.
+	QuietPeriodWindow time.Duration
+
+	// QuietPeriodInterval is the poll interval during a quiet period, which
+	// is only applied where longer than the poll interval.  Defaults to 30s.
+	QuietPeriodInterval time.Duration
+
+	// QuietPeriodDuration is how long a quiet period lasts.  Defaults to 5m.
+	QuietPeriodDuration time.Duration
+
+	// PrometheusRegisterer, when set, is used to register Prometheus
+	// collectors mirroring the queue's metrics.  The metrics are only sent
+	// to the metrics package when nil.
+	PrometheusRegisterer prometheus.Registerer
+
+	// Clock is the source of time for polling, retries, and tracking of
+	// unacknowledged and deadlettered jobs.  Defaults to the real clock.
+	Clock Clock
+
+	// PayloadStrictness determines how fields of a job payload that are
+	// unknown to worker are handled, and is one of
+	// HTTPPayloadStrictnessLenient, HTTPPayloadStrictnessWarn or
+	// HTTPPayloadStrictnessError.  Defaults to HTTPPayloadStrictnessLenient.
+	PayloadStrictness string
+
+	// ZeroCapacityMode determines whether job-board is polled when the
+	// capacity is zero, and is one of HTTPZeroCapacityModePoll or
+	// HTTPZeroCapacityModeSkip.  Defaults to HTTPZeroCapacityModePoll.
+	ZeroCapacityMode string
+}
+
+// NewHTTPJobQueue creates a new http job queue.  The given infrastructure is
+// sent to job-board as the Travis-Infrastructure header, and falls back to the
+// provider name when empty.
+func NewHTTPJobQueue(jobBoardURL *url.URL, site, providerName, infrastructure, queue string,
 	cb *CancellationBroadcaster) (*HTTPJobQueue, error) {
 
-	return &HTTPJobQueue{
-		jobBoardURL:          jobBoardURL,
-		site:                 site,
-		providerName:         providerName,
-		queue:                queue,
-		pollInterval:         3 * time.Second,
-		refreshClaimInterval: 5 * time.Second,
-		cb:                   cb,
-	}, nil
+	return NewHTTPJobQueueWithConfig(&HTTPJobQueueConfig{
+		JobBoardURL:    jobBoardURL,
+		Site:           site,
+		ProviderName:   providerName,
+		Infrastructure: infrastructure,
+		Queue:          queue,
+	}, cb)
 }
 
 // NewHTTPJobQueueWithIntervals creates a new http job queue with the specified
 // poll and refresh claim intervals
-func NewHTTPJobQueueWithIntervals(jobBoardURL *url.URL, site, providerName, queue string,
+func NewHTTPJobQueueWithIntervals(jobBoardURL *url.URL, site, providerName, infrastructure, queue string,
 	pollInterval, refreshClaimInterval time.Duration,
 	cb *CancellationBroadcaster) (*HTTPJobQueue, error) {
 
-	return &HTTPJobQueue{
-		jobBoardURL:          jobBoardURL,
-		site:                 site,
-		providerName:         providerName,
-		queue:                queue,
-		pollInterval:         pollInterval,
-		refreshClaimInterval: refreshClaimInterval,
+	return NewHTTPJobQueueWithConfig(&HTTPJobQueueConfig{
+		JobBoardURL:          jobBoardURL,
+		Site:                 site,
+		ProviderName:         providerName,
+		Infrastructure:       infrastructure,
+		Queue:                queue,
+		PollInterval:         pollInterval,
+		RefreshClaimInterval: refreshClaimInterval,
+	}, cb)
+}
+
+// NewHTTPJobQueueWithConfig creates a new http job queue from the given
+// config, applying defaults for any unset tunables
+func NewHTTPJobQueueWithConfig(cfg *HTTPJobQueueConfig, cb *CancellationBroadcaster) (*HTTPJobQueue, error) {
+	q := &HTTPJobQueue{
+		jobBoardURL:          cfg.JobBoardURL,
+		urlResolver:          cfg.URLResolver,
+		site:                 cfg.Site,
+		sites:                cfg.Sites,
+		siteStrategy:         cfg.SiteStrategy,
+		providerName:         cfg.ProviderName,
+		infrastructure:       cfg.Infrastructure,
+		queue:                cfg.Queue,
+		pollInterval:         cfg.PollInterval,
+		pollTimeoutFactor:    cfg.PollTimeoutFactor,
+		reserveTimeout:       cfg.ReserveTimeout,
+		refreshClaimInterval: cfg.RefreshClaimInterval,
+		retryMaxInterval:     cfg.RetryMaxInterval,
+		retryMaxElapsedTime:  cfg.RetryMaxElapsedTime,
+		maxRetries:           cfg.MaxRetries,
+		provider:             cfg.Provider,
+		repositoryAllowList:  cfg.RepositoryAllowList,
+		repositoryDenyList:   cfg.RepositoryDenyList,
+		requireVMType:        cfg.RequireVMType,
+		processors:           cfg.Processors,
+		resourceMonitor:      cfg.ResourceMonitor,
+		zeroCapacityMode:     cfg.ZeroCapacityMode,
+		payloadStrictness:    cfg.PayloadStrictness,
+		reportQueueDepth:     cfg.ReportQueueDepth,
+		clock:                cfg.Clock,
 		cb:                   cb,
-	}, nil
+		unackedJobs:          map[uint64]*httpUnackedJob{},
+		jobSites:             map[uint64]string{},
+
+		dispatchedJobs:            map[uint64]*httpJob{},
+		pollConcurrency:           cfg.PollConcurrency,
+		delayFirstFetch:           cfg.DelayFirstFetch,
+		maxAdvertisedCapacity:     cfg.MaxAdvertisedCapacity,
+		idleGraceWindow:           cfg.IdleGraceWindow,
+		inFlightJobs:              map[uint64]struct{}{},
+		maxBufferedPayloadBytes:   cfg.MaxBufferedPayloadBytes,
+		maxConcurrentProvisioning: cfg.MaxConcurrentProvisioning,
+		provisioningJobs:          map[uint64]time.Time{},
+
+		fetchFailureThreshold: cfg.FetchFailureThreshold,
+		deadletterTTL:         cfg.DeadletterTTL,
+		fetchFailures:         map[uint64]*httpFetchFailure{},
+		deadletteredJobs:      map[uint64]time.Time{},
+
+		heartbeatInterval: cfg.HeartbeatInterval,
+		done:              make(chan struct{}),
+
+		statePath:        cfg.StatePath,
+		prefetchTTL:      cfg.PrefetchTTL,
+		prefetching:      map[gocontext.Context]bool{},
+		prefetchedJobIDs: map[gocontext.Context]*httpPrefetchedJobID{},
+
+		maxUnsentAge:    cfg.MaxUnsentAge,
+		healthProbePath: cfg.HealthProbePath,
+
+		quietPeriodErrors:   cfg.QuietPeriodErrors,
+		quietPeriodWindow:   cfg.QuietPeriodWindow,
+		quietPeriodInterval: cfg.QuietPeriodInterval,
+		quietPeriodDuration: cfg.QuietPeriodDuration,
+	}
+
+	if q.pollInterval == 0 {
+		q.pollInterval = 3 * time.Second
+	}
+	if q.refreshClaimInterval == 0 {
+		q.refreshClaimInterval = 5 * time.Second
+	}
+	if q.retryMaxInterval == 0 {
+		q.retryMaxInterval = 10 * time.Second
+	}
+	if q.retryMaxElapsedTime == 0 {
+		q.retryMaxElapsedTime = time.Minute
+	}
+	if q.clock == nil {
+		q.clock = realClock{}
+	}
+	if q.fetchFailureThreshold == 0 {
+		q.fetchFailureThreshold = 3
+	}
+	if q.deadletterTTL == 0 {
+		q.deadletterTTL = 15 * time.Minute
+	}
+	if q.pollConcurrency <= 0 {
+		q.pollConcurrency = 1
+	}
+	if q.quietPeriodWindow == 0 {
+		q.quietPeriodWindow = time.Minute
+	}
+	if q.quietPeriodInterval == 0 {
+		q.quietPeriodInterval = 30 * time.Second
+	}
+	if q.quietPeriodDuration == 0 {
+		q.quietPeriodDuration = 5 * time.Minute
+	}
+
+	if q.healthProbePath == "" {
+		q.healthProbePath = "/jobs"
+	}
+
+	if len(q.sites) == 0 {
+		q.sites = []string{q.site}
+	}
+	if q.site == "" {
+		q.site = q.sites[0]
+	}
+
+	if q.reserveTimeout != 0 && q.reserveTimeout < time.Second {
+		return nil, errors.Errorf("reserve timeout %s is shorter than 1s", q.reserveTimeout)
+	}
+	if q.reserveTimeout != 0 && q.pollTimeoutFactor > 0 && q.reserveTimeout >= q.pollInterval*time.Duration(q.pollTimeoutFactor) {
+		return nil, errors.Errorf("reserve timeout %s isn't shorter than the poll timeout %s",
+			q.reserveTimeout, q.pollInterval*time.Duration(q.pollTimeoutFactor))
+	}
+
+	err := validateHealthProbePath(q.healthProbePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range append(append([]string{}, q.repositoryAllowList...), q.repositoryDenyList...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid repository pattern %q", pattern)
+		}
+	}
+
+	if cfg.Processors != nil && isNilProcessors(cfg.Processors) {
+		return nil, errors.Errorf("processors must not be a nil %T", cfg.Processors)
+	}
+
+	switch q.siteStrategy {
+	case "":
+		q.siteStrategy = HTTPSiteStrategyPriority
+	case HTTPSiteStrategyPriority, HTTPSiteStrategyRoundRobin:
+	default:
+		return nil, errors.Errorf("unknown site strategy %q", q.siteStrategy)
+	}
+
+	switch q.zeroCapacityMode {
+	case "":
+		q.zeroCapacityMode = HTTPZeroCapacityModePoll
+	case HTTPZeroCapacityModePoll, HTTPZeroCapacityModeSkip:
+	default:
+		return nil, errors.Errorf("unknown zero capacity mode %q", q.zeroCapacityMode)
+	}
+
+	switch q.payloadStrictness {
+	case "":
+		q.payloadStrictness = HTTPPayloadStrictnessLenient
+	case HTTPPayloadStrictnessLenient, HTTPPayloadStrictnessWarn, HTTPPayloadStrictnessError:
+	default:
+		return nil, errors.Errorf("unknown payload strictness %q", q.payloadStrictness)
+	}
+
+	if cfg.PrometheusRegisterer != nil {
+		m, err := newHTTPJobQueuePrometheusMetrics(cfg.PrometheusRegisterer, q.providerName, q.site)
+		if err != nil {
+			return nil, err
+		}
+		q.prometheus = m
+	}
+
+	q.httpClient = &http.Client{CheckRedirect: q.checkRedirect}
+	if cfg.RecordPath != "" {
+		recorder, err := newHTTPRecorder(http.DefaultTransport, cfg.RecordPath, cfg.RecordMaxBytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't create http recorder")
+		}
+		q.recorder = recorder
+		q.httpClient.Transport = recorder
+	}
+
+	q.loadState()
+
+	return q, nil
 }
 
 // Jobs consumes new jobs from job-board
@@ -93,26 +773,174 @@ func (q *HTTPJobQueue) Jobs(ctx gocontext.Context) (outChan <-chan Job, err erro
 		"inst": fmt.Sprintf("%p", q),
 	})
 
+	q.lifecycleMutex.Lock()
+	defer q.lifecycleMutex.Unlock()
+
+	select {
+	case <-q.done:
+		logger.Warn("jobs requested after cleanup")
+		close(buildJobChan)
+		return outChan, nil
+	default:
+	}
+
+	// NOTE: polling stops once either the given context is done or the queue
+	// is cleaned up.
+	ctx, cancel := gocontext.WithCancel(ctx)
+	go func() {
+		select {
+		case <-q.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// NOTE: buildJobChan is only sent to by the polling goroutines, and is
+	// closed by this goroutine once every one of them has terminated.  The
+	// polling goroutines take turns through pollToken, which is held from
+	// polling for a job until the processor is ready for another one, so
+	// that no job is claimed while it can't be received.
+	pollToken := make(chan struct{}, 1)
+	pollToken <- struct{}{}
+	pollWg := sync.WaitGroup{}
+	for i := 0; i < q.pollConcurrency; i++ {
+		pollWg.Add(1)
+		go func() {
+			defer pollWg.Done()
+			q.poll(ctx, logger, buildJobChan, pollToken)
+		}()
+	}
+
+	q.pollers.Add(1)
 	go func() {
+		defer q.pollers.Done()
 		defer close(buildJobChan)
 
-		for {
-			logger.Debug("polling for job tick")
-			pollInterval, keepPolling, readyChan := q.pollForJob(ctx, buildJobChan)
-			if readyChan != nil {
-				readyWaitBegin := time.Now()
-				logger.Debug("blocking on ready channel recv")
-				<-readyChan
-				metrics.TimeSince("travis.worker.job_queue.http.ready_wait_time", readyWaitBegin)
-			}
-			if !keepPolling {
+		pollWg.Wait()
+		cancel()
+		q.invalidatePrefetchedJobID(ctx)
+	}()
+
+	return outChan, nil
+}
+
+// poll polls job-board for jobs to send to the given channel, one at a time,
+// until either polling stops or the given context is done.  It only polls
+// while holding the given poll token, which it hands on once the processor is
+// ready for another job.
+func (q *HTTPJobQueue) poll(ctx gocontext.Context, logger *logrus.Entry, buildJobChan chan Job, pollToken chan struct{}) {
+	if !q.waitForConsumer(ctx) {
+		logger.WithField("err", ctx.Err()).Info("context done while waiting for consumer")
+		return
+	}
+
+	for {
+		select {
+		case <-pollToken:
+		case <-ctx.Done():
+			logger.WithField("err", ctx.Err()).Info("context done while waiting for poll token")
+			return
+		}
+
+		logger.Debug("polling for job tick")
+		pollInterval, keepPolling, readyChan := q.pollForJob(ctx, buildJobChan)
+		if readyChan != nil && !keepPolling {
+			// NOTE: a ready channel is only returned after a job has been
+			// sent, at which point polling must continue.
+			logger.Error("inconsistent poll state; job sent but polling stopped")
+			q.mark("inconsistent_state")
+		}
+		if readyChan != nil && keepPolling {
+			q.prefetchJobID(ctx)
+
+			if !q.waitForReady(ctx, readyChan) {
+				logger.WithField("err", ctx.Err()).Info("context done while waiting on ready channel")
 				return
 			}
-			time.Sleep(pollInterval)
 		}
-	}()
+		pollToken <- struct{}{}
 
-	return outChan, nil
+		if !keepPolling {
+			return
+		}
+		pollInterval = q.quietPollInterval(pollInterval)
+		q.recordPollInterval(pollInterval)
+		select {
+		case <-q.clock.After(pollInterval):
+		case <-ctx.Done():
+			logger.WithField("err", ctx.Err()).Info("context done; stopping polling")
+			return
+		}
+	}
+}
+
+// waitForConsumer blocks until the processor the given context belongs to has
+// joined the processors, if the first fetch is delayed, and returns whether
+// polling may start.  It only applies before the first fetch: the receiver of
+// a job that has been sent is known to be there, and polling then waits on
+// the job's ready channel instead.
+func (q *HTTPJobQueue) waitForConsumer(ctx gocontext.Context) bool {
+	if !q.delayFirstFetch {
+		return true
+	}
+	processorID, ok := context.ProcessorFromContext(ctx)
+	if !ok {
+		return true
+	}
+
+	waitBegin := q.clock.Now()
+	for {
+		processors := q.currentProcessors()
+		if processors == nil {
+			return true
+		}
+
+		found := false
+		processors.Each(func(_ int, p *Processor) {
+			found = found || p.ID == processorID
+		})
+		if found {
+			q.timeSince("consumer_wait_time", waitBegin)
+			return ctx.Err() == nil
+		}
+
+		select {
+		case <-q.clock.After(q.pollInterval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// waitForReady blocks until the given ready channel is closed, and returns
+// whether polling may continue.
+//
+// A ready channel is never sent on.  It is closed once the claim of the job it
+// was returned for is no longer refreshed, which signals that the receiving
+// processor is ready for another job.  A closed ready channel therefore means
+// "ready", and never "stop": polling only stops once the context is done.
+// As each ready channel belongs to a single dispatched job, and the poll
+// interval is still waited for after it is closed, a closed ready channel
+// doesn't cause polling to spin.
+func (q *HTTPJobQueue) waitForReady(ctx gocontext.Context, readyChan <-chan struct{}) bool {
+	if readyChan == nil {
+		return ctx.Err() == nil
+	}
+
+	readyWaitBegin := q.clock.Now()
+	context.LoggerFromContext(ctx).WithField("self", "http_job_queue").Debug("blocking on ready channel recv")
+
+	select {
+	case _, ok := <-readyChan:
+		if ok {
+			context.LoggerFromContext(ctx).WithField("self", "http_job_queue").Error("unexpected send on ready channel")
+			q.mark("ready_chan_sent")
+		}
+		q.timeSince("ready_wait_time", readyWaitBegin)
+		return ctx.Err() == nil
+	case <-ctx.Done():
+		return false
+	}
 }
 
 // pollForJob is responsible for first fetching a job ID, if available, and then
@@ -127,40 +955,138 @@ func (q *HTTPJobQueue) pollForJob(ctx gocontext.Context, buildJobChan chan Job)
 		"inst": fmt.Sprintf("%p", q),
 	})
 
+	if q.shedLoad(ctx) {
+		logger.Debug("skipping poll under resource pressure")
+		q.mark("load_shed")
+		return q.pollInterval, true, nil
+	}
+
+	if capacity, _, ok := q.capacity(); ok && capacity == 0 && q.zeroCapacityMode == HTTPZeroCapacityModeSkip {
+		logger.Debug("skipping poll at zero capacity")
+		q.markReason("skipped", "zero_capacity")
+		return q.pollInterval, true, nil
+	}
+
+	if q.payloadBudgetExceeded() {
+		logger.Debug("skipping poll with buffered payload budget exceeded")
+		q.mark("payload_budget_exceeded")
+		return q.pollInterval, true, nil
+	}
+
+	if !q.reserveProvisioning() {
+		logger.Debug("skipping poll at provisioning limit")
+		q.mark("provisioning_limit")
+		return q.pollInterval, true, nil
+	}
+	reserved := true
+	defer func() {
+		if reserved {
+			q.releaseProvisioning()
+		}
+	}()
+
+	stats := &httpDispatchStats{}
+
 	logger.Debug("fetching job id")
-	pollInterval, jobID, err := q.fetchJobID(ctx)
+	fetchJobIDBegin := q.clock.Now()
+	pollInterval, jobID, fetchedAt, err := q.nextJobID(ctx)
+	stats.fetchJobIDDuration = q.clock.Now().Sub(fetchJobIDBegin)
+	q.timeSince("fetch_job_id_time", fetchJobIDBegin)
+	q.recordPoll(fetchJobIDBegin)
+	if err == httpJobQueueNoJobsErr {
+		q.mark("no_jobs")
+	} else if err != nil {
+		q.recordError(err)
+	}
 	if err != nil {
 		logger.WithField("err", err).Debug("continuing after failing to get job id")
 		return pollInterval, true, nil
 	}
-	logger.WithField("job_id", jobID).Debug("fetching complete job")
-	buildJob, readyChan, err := q.fetchJob(ctx, jobID)
+	if !q.beginInFlight(jobID) {
+		logger.WithField("job_id", jobID).Debug("skipping job fetched by another poller")
+		q.markReason("skipped", "in_flight")
+		return pollInterval, true, nil
+	}
+	defer q.endInFlight(jobID)
+	defer func() {
+		if reserved {
+			q.forgetJobSite(jobID)
+		}
+	}()
+
+	// NOTE: the job ID is carried in the context from here on, so that every
+	// log line about this job, up to and including its dispatch, has it.
+	ctx = context.FromJobID(ctx, jobID)
+	logger = context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"self": "http_job_queue",
+		"inst": fmt.Sprintf("%p", q),
+	})
+
+	if q.deadlettered(jobID) {
+		logger.Debug("skipping deadlettered job")
+		q.markReason("skipped", "deadlettered")
+		q.releaseDeadletteredJob(ctx, jobID)
+		return pollInterval, true, nil
+	}
+	logger.Debug("fetching complete job")
+	fetchJobBegin := q.clock.Now()
+	buildJob, readyChan, err := q.fetchJob(ctx, jobID, stats)
+	stats.fetchJobDuration = q.clock.Now().Sub(fetchJobBegin)
+	q.timeSince("fetch_job_time", fetchJobBegin)
+	if errors.Cause(err) == httpJobDeclinedErr {
+		logger.WithField("err", err).Info("declined job")
+		return pollInterval, true, nil
+	}
 	if err != nil {
-		logger.WithFields(logrus.Fields{
-			"err": err,
-			"id":  jobID,
-		}).Warn("failed to get complete job")
+		logger.WithField("err", err).Warn("failed to get complete job")
+		q.recordError(err)
+		if ctx.Err() == nil {
+			q.recordFetchFailure(ctx, jobID)
+		}
 		return pollInterval, true, nil
 	}
 
-	logger.WithField("job_id", jobID).Debug("sending job to output channel")
-	jobSendBegin := time.Now()
+	q.clearFetchFailures(jobID)
+	q.recordFetched()
+	q.trackUnackedJob(jobID, stats.payloadBytes)
+	q.trackDispatchedJob(jobID, buildJob)
+	q.beginProvisioning(jobID)
+	reserved = false
+
+	var staleChan <-chan time.Time
+	if q.maxUnsentAge > 0 {
+		age := q.clock.Now().Sub(fetchedAt)
+		if age >= q.maxUnsentAge {
+			q.discardStaleJob(ctx, jobID, buildJob, age)
+			return pollInterval, true, nil
+		}
+		staleChan = q.clock.After(q.maxUnsentAge - age)
+	}
+
+	logger.Debug("sending job to output channel")
+	jobSendBegin := q.clock.Now()
 	select {
+	case <-staleChan:
+		q.discardStaleJob(ctx, jobID, buildJob, q.clock.Now().Sub(fetchedAt))
+		return pollInterval, true, nil
 	case buildJobChan <- buildJob:
-		metrics.TimeSince("travis.worker.job_queue.http.blocking_time", jobSendBegin)
-		logger.WithFields(logrus.Fields{
-			"source":           "http",
-			"send_duration_ms": time.Since(jobSendBegin).Seconds() * 1e3,
-		}).Info("sent job to output channel")
+		stats.blockingDuration = q.clock.Now().Sub(jobSendBegin)
+		q.timeSince("blocking_time", jobSendBegin)
+		q.mark("dispatched")
+		q.recordDispatched()
+		logger.WithFields(stats.fields()).WithField("source", "http").Info("sent job to output channel")
 		return pollInterval, true, readyChan
 	case <-ctx.Done():
+		q.dropUnackedJob(ctx, jobID, "context_done")
+		q.untrackDispatchedJob(jobID)
+		q.endProvisioning(jobID)
 		if j, ok := buildJob.(*httpJob); ok {
 			if processorID, ok := context.ProcessorFromContext(ctx); ok {
 				// best-effort delete
 				delCtx := context.FromProcessor(
-					context.FromJWT(gocontext.TODO(), j.payload.JWT),
+					context.FromJWT(context.FromJobID(gocontext.TODO(), jobID), j.payload.JWT),
 					processorID)
-				logger.WithField("job_id", jobID).Warn("context done; deleting job")
+				logger.Warn("context done; deleting job")
 				_ = q.deleteJob(delCtx, jobID)
 			}
 		}
@@ -169,107 +1095,442 @@ func (q *HTTPJobQueue) pollForJob(ctx gocontext.Context, buildJobChan chan Job)
 	}
 }
 
-func (q *HTTPJobQueue) fetchJobID(ctx gocontext.Context) (time.Duration, uint64, error) {
+// nextJobID returns the prefetched job ID if there is a fresh one, and
+// otherwise fetches a job ID from job-board, along with when it was fetched.
+func (q *HTTPJobQueue) nextJobID(ctx gocontext.Context) (time.Duration, uint64, time.Time, error) {
+	if prefetched, ok := q.takePrefetchedJobID(ctx); ok {
+		return prefetched.pollInterval, prefetched.jobID, prefetched.fetchedAt, nil
+	}
+
+	fetchedAt := q.clock.Now()
+	pollInterval, jobID, err := q.fetchJobID(ctx)
+	return pollInterval, jobID, fetchedAt, err
+}
+
+// discardStaleJob hands a job that has exceeded the maximum unsent age back
+// to job-board instead of sending it, so that it is fetched afresh.
+func (q *HTTPJobQueue) discardStaleJob(ctx gocontext.Context, jobID uint64, buildJob Job, age time.Duration) {
 	logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
-		"self": "http_job_queue",
-		"inst": fmt.Sprintf("%p", q),
+		"self":  "http_job_queue",
+		"age_s": age.Seconds(),
 	})
+	logger.Warn("discarding job fetched too long ago")
+	q.mark("stale_discarded")
 
-	processorID, ok := context.ProcessorFromContext(ctx)
+	q.dropUnackedJob(ctx, jobID, "stale")
+	q.untrackDispatchedJob(jobID)
+	q.endProvisioning(jobID)
+
+	j, ok := buildJob.(*httpJob)
 	if !ok {
-		processorID = "unknown-processor"
+		return
 	}
 
-	u := *q.jobBoardURL
-
-	query := u.Query()
-	query.Add("queue", q.queue)
-
-	u.Path = "/jobs/pop"
-	u.RawQuery = query.Encode()
+	ctx = context.FromJWT(ctx, j.payload.JWT)
+	err := j.Requeue(ctx)
+	if err == nil {
+		err = q.deleteJob(ctx, jobID)
+	}
+	if err != nil {
+		logger.WithField("err", err).Error("couldn't hand stale job back to job-board")
+	}
+}
 
-	client := &http.Client{}
+// prefetchJobID fetches a job ID to be used by the next poll with the given
+// context, unless prefetching is disabled or a job ID has already been
+// prefetched for it.  Job IDs which are deadlettered or already dispatched are
+// not kept.  As popping a job ID reserves the job for this worker, job IDs
+// which aren't kept or used are handed back to job-board.
+func (q *HTTPJobQueue) prefetchJobID(ctx gocontext.Context) {
+	if q.prefetchTTL == 0 {
+		return
+	}
 
-	req, err := http.NewRequest("POST", u.String(), nil)
-	if err != nil {
-		return q.pollInterval, 0, errors.Wrap(err, "failed to create job-board job pop request")
+	q.prefetchMutex.Lock()
+	if q.prefetching[ctx] || q.prefetchedJobIDs[ctx] != nil {
+		q.prefetchMutex.Unlock()
+		return
 	}
+	q.prefetching[ctx] = true
+	q.prefetchMutex.Unlock()
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Travis-Site", q.site)
-	req.Header.Add("From", processorID)
-	req = req.WithContext(ctx)
+	defer func() {
+		q.prefetchMutex.Lock()
+		delete(q.prefetching, ctx)
+		q.prefetchMutex.Unlock()
+	}()
 
-	resp, err := client.Do(req)
+	pollInterval, jobID, err := q.fetchJobID(ctx)
 	if err != nil {
-		return q.pollInterval, 0, errors.Wrap(err, "failed to make job-board job pop request")
+		return
+	}
+	if q.deadlettered(jobID) {
+		q.markReason("skipped", "deadlettered")
+		q.releaseDeadletteredJob(context.FromJobID(ctx, jobID), jobID)
+		return
+	}
+	q.dispatchedJobsMutex.Lock()
+	_, dispatched := q.dispatchedJobs[jobID]
+	q.dispatchedJobsMutex.Unlock()
+	if dispatched {
+		// NOTE: the job is being run by this worker, so its reservation and
+		// site are left as they are rather than handed back.
+		q.recordDrop(ctx, jobID, "prefetch_duplicate")
+		return
 	}
 
-	defer resp.Body.Close()
+	q.prefetchMutex.Lock()
+	defer q.prefetchMutex.Unlock()
 
-	pollInterval := q.pollInterval
-	if v, err := strconv.ParseUint(resp.Header.Get("Travis-Pop-Interval"), 10, 64); err == nil {
-		pollInterval = time.Duration(v) * time.Second
+	q.prefetchedJobIDs[ctx] = &httpPrefetchedJobID{
+		ctx:          ctx,
+		jobID:        jobID,
+		pollInterval: pollInterval,
+		fetchedAt:    q.clock.Now(),
 	}
+	q.mark("prefetched")
+}
 
-	if resp.StatusCode == http.StatusNoContent {
-		return pollInterval, 0, httpJobQueueNoJobsErr
+// takePrefetchedJobID removes and returns the job ID prefetched with the
+// given context, if there is one which has neither expired nor been fetched
+// by a poller that has since stopped.  A prefetched job ID which can't be used
+// is handed back.
+func (q *HTTPJobQueue) takePrefetchedJobID(ctx gocontext.Context) (*httpPrefetchedJobID, bool) {
+	q.prefetchMutex.Lock()
+	prefetched := q.prefetchedJobIDs[ctx]
+	delete(q.prefetchedJobIDs, ctx)
+	q.prefetchMutex.Unlock()
+
+	if prefetched == nil {
+		return nil, false
 	}
 
-	fetchResponsePayload := map[string]string{"job_id": ""}
-	err = json.NewDecoder(resp.Body).Decode(&fetchResponsePayload)
-	if err != nil {
-		return pollInterval, 0, errors.Wrap(err, "failed to decode job-board job pop response")
+	if prefetched.ctx.Err() != nil {
+		q.releasePrefetchedJobID(prefetched.jobID, "prefetch_invalidated")
+		return nil, false
+	}
+	if q.clock.Now().Sub(prefetched.fetchedAt) > q.prefetchTTL {
+		q.releasePrefetchedJobID(prefetched.jobID, "prefetch_expired")
+		return nil, false
 	}
 
-	fetchedJobID, err := strconv.ParseUint(fetchResponsePayload["job_id"], 10, 64)
-	if err != nil {
-		return pollInterval, 0, errors.Wrap(err, "failed to parse job ID")
+	q.mark("prefetch_hit")
+	return prefetched, true
+}
+
+// invalidatePrefetchedJobID discards the prefetched job ID if it was fetched
+// with the given context, handing it back.
+func (q *HTTPJobQueue) invalidatePrefetchedJobID(ctx gocontext.Context) {
+	q.prefetchMutex.Lock()
+	prefetched := q.prefetchedJobIDs[ctx]
+	if prefetched == nil {
+		q.prefetchMutex.Unlock()
+		return
 	}
+	delete(q.prefetchedJobIDs, ctx)
+	q.prefetchMutex.Unlock()
 
-	logger.WithField("job_id", fetchedJobID).Debug("fetched")
-	return pollInterval, fetchedJobID, nil
+	q.releasePrefetchedJobID(prefetched.jobID, "prefetch_invalidated")
 }
 
-func (q *HTTPJobQueue) deleteJob(ctx gocontext.Context, jobID uint64) error {
-	logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
-		"self": "http_job_queue",
-	})
+// releasePrefetchedJobID records a prefetched job ID that won't be used as
+// dropped, and hands it back to job-board by deleting its reservation.  The
+// context of the poller that fetched it may be done by then, so the release
+// isn't bound to it.
+func (q *HTTPJobQueue) releasePrefetchedJobID(jobID uint64, reason string) {
+	ctx := context.FromJobID(gocontext.Background(), jobID)
+	q.recordDrop(ctx, jobID, reason)
 
-	logger.Info("deleting job")
+	err := q.deleteJob(ctx, jobID)
+	if err != nil {
+		context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"self":   "http_job_queue",
+			"job_id": jobID,
+			"err":    err,
+		}).Warn("couldn't release prefetched job")
+	}
+}
 
-	jwt, ok := context.JWTFromContext(ctx)
-	if !ok {
-		return errors.New("failed to delete job; no jwt in context")
+// fetchJobID fetches a job ID from each site in the order given by the site
+// strategy, until one of the sites has a job.  The site of the job is kept so
+// that further requests for the job are sent with its Travis-Site header.
+func (q *HTTPJobQueue) fetchJobID(ctx gocontext.Context) (time.Duration, uint64, error) {
+	if len(q.sites) == 1 {
+		return q.fetchJobIDFromSite(ctx, q.sites[0])
 	}
 
-	processorID, ok := context.ProcessorFromContext(ctx)
-	if !ok {
-		processorID = "unknown-processor"
+	var pollInterval time.Duration
+	err := httpJobQueueNoJobsErr
+	for i, site := range q.orderedSites() {
+		siteBegin := q.clock.Now()
+		sitePollInterval, jobID, siteErr := q.fetchJobIDFromSite(ctx, site)
+		q.siteTimeSince(site, "fetch_job_id_time", siteBegin)
+		if i == 0 || sitePollInterval < pollInterval {
+			pollInterval = sitePollInterval
+		}
+
+		switch siteErr {
+		case nil:
+			q.siteMark(site, "job_id")
+			q.sitesMutex.Lock()
+			q.jobSites[jobID] = site
+			q.sitesMutex.Unlock()
+			return sitePollInterval, jobID, nil
+		case httpJobQueueNoJobsErr:
+			q.siteMark(site, "no_jobs")
+		default:
+			q.siteMark(site, "fetch_job_id_error")
+			err = siteErr
+		}
 	}
 
-	u := *q.jobBoardURL
-	u.Path = fmt.Sprintf("/jobs/%d", jobID)
-	u.User = nil
+	return pollInterval, 0, err
+}
 
-	req, err := http.NewRequest("DELETE", u.String(), nil)
-	if err != nil {
-		return err
+// orderedSites returns the sites in the order they're to be polled in.
+func (q *HTTPJobQueue) orderedSites() []string {
+	if q.siteStrategy != HTTPSiteStrategyRoundRobin {
+		return q.sites
 	}
 
-	req.Header.Add("Travis-Site", q.site)
-	req.Header.Add("Authorization", "Bearer "+jwt)
-	req.Header.Add("From", processorID)
+	q.sitesMutex.Lock()
+	start := q.nextSite
+	q.nextSite = (q.nextSite + 1) % len(q.sites)
+	q.sitesMutex.Unlock()
 
-	bo := backoff.NewExponentialBackOff()
-	bo.MaxInterval = 10 * time.Second
-	bo.MaxElapsedTime = 1 * time.Minute
+	return append(append([]string{}, q.sites[start:]...), q.sites[:start]...)
+}
 
-	logger.WithField("url", u.String()).Debug("performing DELETE request")
+// siteFor returns the site the given job was fetched from.
+func (q *HTTPJobQueue) siteFor(jobID uint64) string {
+	q.sitesMutex.Lock()
+	defer q.sitesMutex.Unlock()
 
-	var resp *http.Response
-	err = backoff.Retry(func() (err error) {
-		resp, err = http.DefaultClient.Do(req)
+	if site, ok := q.jobSites[jobID]; ok {
+		return site
+	}
+	return q.site
+}
+
+func (q *HTTPJobQueue) forgetJobSite(jobID uint64) {
+	q.sitesMutex.Lock()
+	defer q.sitesMutex.Unlock()
+
+	delete(q.jobSites, jobID)
+}
+
+func (q *HTTPJobQueue) fetchJobIDFromSite(ctx gocontext.Context, site string) (time.Duration, uint64, error) {
+	logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"self": "http_job_queue",
+		"inst": fmt.Sprintf("%p", q),
+	})
+
+	processorID, ok := context.ProcessorFromContext(ctx)
+	if !ok {
+		processorID = "unknown-processor"
+	}
+
+	u, err := q.resolveURL(ctx)
+	if err != nil {
+		return q.pollInterval, 0, err
+	}
+
+	query := u.Query()
+	query.Add("queue", q.queue)
+	if q.reserveTimeout > 0 {
+		query.Add("reserve_timeout", strconv.FormatInt(int64(q.reserveTimeout/time.Second), 10))
+	}
+	if capacity, poolSize, ok := q.capacity(); ok {
+		capacity = q.clampCapacity(ctx, capacity)
+		q.gauge("capacity", int64(capacity))
+		q.gauge("pool_size", int64(poolSize))
+		query.Add("capacity", strconv.Itoa(capacity))
+		query.Add("pool_size", strconv.Itoa(poolSize))
+		if vmTypes := q.readyVMTypes(); len(vmTypes) > 0 {
+			query.Add("vm_types", strings.Join(vmTypes, ","))
+		}
+		if capacity == 0 {
+			query.Add("full", "true")
+		}
+	}
+
+	u.Path = "/jobs/pop"
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), nil)
+	if err != nil {
+		return q.pollInterval, 0, errors.Wrap(err, "failed to create job-board job pop request")
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Travis-Site", site)
+	req.Header.Add("From", processorID)
+	if q.reportQueueDepth {
+		req.Header.Add("Travis-Queue-Depth", strconv.Itoa(q.queueDepth()))
+	}
+
+	reqCtx := ctx
+	if q.pollTimeoutFactor > 0 {
+		var cancel gocontext.CancelFunc
+		reqCtx, cancel = gocontext.WithTimeout(ctx, q.pollInterval*time.Duration(q.pollTimeoutFactor))
+		defer cancel()
+	}
+	req = req.WithContext(reqCtx)
+
+	resp, err := q.httpClient.Do(req)
+	if err != nil {
+		q.markPollTimeout(ctx, reqCtx)
+		return q.pollInterval, 0, errors.Wrap(err, "failed to make job-board job pop request")
+	}
+
+	defer resp.Body.Close()
+
+	pollInterval := q.pollInterval
+	if v, err := strconv.ParseUint(resp.Header.Get("Travis-Pop-Interval"), 10, 64); err == nil {
+		pollInterval = time.Duration(v) * time.Second
+	}
+
+	if resp.StatusCode == http.StatusNoContent {
+		return pollInterval, 0, httpJobQueueNoJobsErr
+	}
+
+	fetchResponsePayload := map[string]string{"job_id": ""}
+	dec := json.NewDecoder(resp.Body)
+	err = dec.Decode(&fetchResponsePayload)
+	if err != nil {
+		q.markPollTimeout(ctx, reqCtx)
+		return pollInterval, 0, errors.Wrap(err, "failed to decode job-board job pop response")
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		// NOTE: anything but whitespace after the response object, e.g. data
+		// appended by a proxy, means the response can't be trusted.
+		q.mark("trailing_garbage")
+		return pollInterval, 0, errors.New("unexpected content after job-board job pop response")
+	}
+
+	fetchedJobID, err := strconv.ParseUint(fetchResponsePayload["job_id"], 10, 64)
+	if err != nil {
+		return pollInterval, 0, errors.Wrap(err, "failed to parse job ID")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"job_id": fetchedJobID,
+		"site":   site,
+	}).Debug("fetched job id")
+	return pollInterval, fetchedJobID, nil
+}
+
+// markPollTimeout reports a job ID request which was aborted because it took
+// longer than its poll timeout, rather than because the poll context is done.
+func (q *HTTPJobQueue) markPollTimeout(ctx, reqCtx gocontext.Context) {
+	if reqCtx.Err() == gocontext.DeadlineExceeded && ctx.Err() == nil {
+		q.mark("fetch_job_id_timeout")
+	}
+}
+
+// httpJobPayloadPassThroughFields are the fields of a job payload's data
+// which worker doesn't type, but passes through to the build script
+// generator.
+var httpJobPayloadPassThroughFields = map[string]bool{
+	"cache_settings": true,
+	"enterprise":     true,
+	"env_vars":       true,
+	"prefer_https":   true,
+	"ssh_key":        true,
+}
+
+// checkUnknownPayloadFields returns an error naming a field of the given job
+// payload which is unknown to worker, if there is any.  Only the envelope and
+// the top level of its data are checked, as the nested objects of the data
+// carry fields which are passed through to the build script generator.
+func checkUnknownPayloadFields(body []byte) error {
+	envelope := struct {
+		httpJobPayload
+		Data json.RawMessage `json:"data"`
+	}{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&envelope)
+	if err != nil || len(envelope.Data) == 0 {
+		return err
+	}
+
+	data := map[string]json.RawMessage{}
+	err = json.Unmarshal(envelope.Data, &data)
+	if err != nil {
+		return err
+	}
+
+	known := jsonFieldNames(reflect.TypeOf(JobPayload{}))
+	for name := range data {
+		if !known[name] && !httpJobPayloadPassThroughFields[name] {
+			return fmt.Errorf("json: unknown field %q in data", name)
+		}
+	}
+	return nil
+}
+
+// jsonFieldNames returns the names under which the fields of the given struct
+// type are encoded as JSON.
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+func (q *HTTPJobQueue) deleteJob(ctx gocontext.Context, jobID uint64) error {
+	logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"self": "http_job_queue",
+	})
+
+	logger.Info("deleting job")
+	defer q.forgetJobSite(jobID)
+
+	processorID, ok := context.ProcessorFromContext(ctx)
+	if !ok {
+		processorID = "unknown-processor"
+	}
+
+	u, err := q.resolveURL(ctx)
+	if err != nil {
+		return err
+	}
+	u.Path = fmt.Sprintf("/jobs/%d", jobID)
+
+	// NOTE: jobs whose payload couldn't be fetched have no jwt, in which case
+	// the job-board credentials used to pop and fetch jobs are used instead.
+	jwt, hasJWT := context.JWTFromContext(ctx)
+	if hasJWT {
+		u.User = nil
+	}
+
+	req, err := http.NewRequest("DELETE", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Travis-Site", q.siteFor(jobID))
+	if hasJWT {
+		req.Header.Add("Authorization", "Bearer "+jwt)
+	}
+	req.Header.Add("From", processorID)
+
+	logURL := u
+	logURL.User = nil
+	logger.WithField("url", logURL.String()).Debug("performing DELETE request")
+
+	var resp *http.Response
+	err = q.retry(ctx, func() (err error) {
+		resp, err = q.httpClient.Do(req)
 		if resp != nil && resp.StatusCode != http.StatusNoContent {
 			logger.WithFields(logrus.Fields{
 				"expected_status": http.StatusNoContent,
@@ -283,7 +1544,7 @@ func (q *HTTPJobQueue) deleteJob(ctx gocontext.Context, jobID uint64) error {
 		}
 
 		return
-	}, bo)
+	})
 
 	if err != nil {
 		return errors.Wrap(err, "failed to delete job with retries")
@@ -326,7 +1587,10 @@ func (q *HTTPJobQueue) refreshJobClaim(ctx gocontext.Context, jobID uint64) (tim
 		processorID = "unknown-processor"
 	}
 
-	u := *q.jobBoardURL
+	u, err := q.resolveURL(ctx)
+	if err != nil {
+		return q.refreshClaimInterval, err
+	}
 	u.User = nil
 
 	query := u.Query()
@@ -335,20 +1599,18 @@ func (q *HTTPJobQueue) refreshJobClaim(ctx gocontext.Context, jobID uint64) (tim
 	u.Path = fmt.Sprintf("/jobs/%v/claim", jobID)
 	u.RawQuery = query.Encode()
 
-	client := &http.Client{}
-
 	req, err := http.NewRequest("POST", u.String(), nil)
 	if err != nil {
 		return q.refreshClaimInterval, errors.Wrap(err, "failed to create job-board job claim request")
 	}
 
 	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Travis-Site", q.site)
+	req.Header.Add("Travis-Site", q.siteFor(jobID))
 	req.Header.Add("From", processorID)
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", jwt))
 	req = req.WithContext(ctx)
 
-	resp, err := client.Do(req)
+	resp, err := q.httpClient.Do(req)
 	if err != nil {
 		return q.refreshClaimInterval, errors.Wrap(err, "failed to make job-board job claim request")
 	}
@@ -369,7 +1631,7 @@ func (q *HTTPJobQueue) refreshJobClaim(ctx gocontext.Context, jobID uint64) (tim
 	return refreshClaimInterval, nil
 }
 
-func (q *HTTPJobQueue) fetchJob(ctx gocontext.Context, jobID uint64) (Job, <-chan struct{}, error) {
+func (q *HTTPJobQueue) fetchJob(ctx gocontext.Context, jobID uint64, stats *httpDispatchStats) (Job, <-chan struct{}, error) {
 	logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
 		"self": "http_job_queue",
 		"inst": fmt.Sprintf("%p", q),
@@ -383,26 +1645,31 @@ func (q *HTTPJobQueue) fetchJob(ctx gocontext.Context, jobID uint64) (Job, <-cha
 	refreshClaimFunc, readyChan := q.generateJobRefreshClaimFunc(jobID)
 
 	buildJob := &httpJob{
-		payload: &httpJobPayload{
-			Data: &JobPayload{},
-		},
-		startAttributes: &backend.StartAttributes{},
+		payload: &httpJobPayload{},
 
 		refreshClaim: refreshClaimFunc,
+		acknowledge: func(ctx gocontext.Context) {
+			q.ackJob(ctx, jobID)
+		},
+		provisioned: func(ctx gocontext.Context) {
+			q.endProvisioning(jobID)
+		},
+		requeuedSelf: func(ctx gocontext.Context) {
+			q.untrackDispatchedJob(jobID)
+		},
 		deleteSelf: func(ctx gocontext.Context) error {
+			q.dropUnackedJob(ctx, jobID, "deleted_before_start")
+			q.untrackDispatchedJob(jobID)
 			return q.deleteJob(ctx, jobID)
 		},
 		cancelSelf: func(ctx gocontext.Context) {
-			q.cb.Broadcast(jobID)
+			q.cb.BroadcastReason(jobID, CancellationReasonConflict)
 		},
 	}
-	startAttrs := &httpJobPayloadStartAttrs{
-		Data: &jobPayloadStartAttrs{
-			Config: &backend.StartAttributes{},
-		},
+	u, err := q.resolveURL(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	u := *q.jobBoardURL
 	u.Path = fmt.Sprintf("/jobs/%d", jobID)
 
 	req, err := http.NewRequest("GET", u.String(), nil)
@@ -410,85 +1677,198 @@ func (q *HTTPJobQueue) fetchJob(ctx gocontext.Context, jobID uint64) (Job, <-cha
 		return nil, nil, errors.Wrap(err, "couldn't make job-board job request")
 	}
 
-	// TODO: ensure infrastructure is not synonymous with providerName since
-	// there's the possibility that a provider has multiple infrastructures, which
-	// is expected to be the case with the future cloudbrain provider.
-	req.Header.Add("Travis-Infrastructure", q.providerName)
-	req.Header.Add("Travis-Site", q.site)
+	req.Header.Add("Travis-Infrastructure", q.infrastructureName())
+	req.Header.Add("Travis-Site", q.siteFor(jobID))
 	req.Header.Add("From", processorID)
 	req = req.WithContext(ctx)
 
-	bo := backoff.NewExponentialBackOff()
-	bo.MaxInterval = 10 * time.Second
-	bo.MaxElapsedTime = 1 * time.Minute
+	var (
+		body    []byte
+		readErr error
+	)
+	attempts := 0
+	err = q.retry(ctx, func() error {
+		attempts++
+		stats.fetchJobRetries = attempts - 1
 
-	var resp *http.Response
-	err = backoff.Retry(func() (err error) {
-		resp, err = (&http.Client{}).Do(req)
-		if resp != nil && resp.StatusCode != http.StatusOK {
+		resp, err := q.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		err = checkJobResponse(resp)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
 			logger.WithFields(logrus.Fields{
 				"expected_status": http.StatusOK,
 				"actual_status":   resp.StatusCode,
 			}).Debug("job fetch failed")
 
-			if resp.Body != nil {
-				resp.Body.Close()
-			}
-
 			return errors.Errorf("expected %d but got %d", http.StatusOK, resp.StatusCode)
 		}
-		return
-	}, bo)
 
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "error making job-board job request")
-	}
+		body, readErr = ioutil.ReadAll(resp.Body)
+		if readErr == io.ErrUnexpectedEOF {
+			// NOTE: the connection was reset before the advertised
+			// Content-Length was read, so the request is worth retrying.
+			logger.WithField("content_length", resp.ContentLength).Debug("job fetch body truncated")
+			q.mark("truncated_body")
+			return readErr
+		}
+		return nil
+	})
 
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	q.gauge("fetch_job_attempts", int64(attempts))
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "error reading body from job-board job request")
+		return nil, nil, errors.Wrapf(err, "error making job-board job request after %d attempts", attempts)
 	}
+	if readErr != nil {
+		return nil, nil, errors.Wrap(readErr, "error reading body from job-board job request")
+	}
+	stats.payloadBytes = len(body)
 
+	data := &httpJobPayloadData{}
 	err = json.Unmarshal(body, buildJob.payload)
+	if err == nil {
+		err = json.Unmarshal(body, data)
+	}
+	if err == nil && len(data.Data) == 0 {
+		// NOTE: a response without "data" has always been run with an empty
+		// payload rather than deleted as unparseable.
+		data.Data = json.RawMessage(`{}`)
+	}
+	if err == nil {
+		buildJob.payload.Data, buildJob.startAttributes, buildJob.rawPayload, err = parseJobPayload(
+			data.Data, q.DefaultLanguage, q.DefaultDist, q.DefaultGroup, q.DefaultOS)
+	}
 	if err != nil {
-		logger.WithField("err", err).Error("payload JSON parse error, attempting to delete job")
-		err := q.deleteJob(ctx, jobID)
+		logger.WithField("err", err).Error("payload parse error, attempting to delete job")
+		q.recordDrop(ctx, jobID, "payload_parse_error")
+		deleteErr := q.deleteJob(ctx, jobID)
+		if deleteErr != nil {
+			return nil, nil, errors.Wrap(deleteErr, "couldn't delete job")
+		}
+		return nil, nil, errors.Wrap(err, "payload parse error")
+	}
+
+	if q.payloadStrictness != HTTPPayloadStrictnessLenient {
+		strictErr := checkUnknownPayloadFields(body)
+		if strictErr != nil {
+			q.mark("unknown_payload_fields")
+			logger.WithFields(logrus.Fields{
+				"err":    strictErr,
+				"job_id": jobID,
+			}).Warn("payload has unknown fields")
+		}
+		if strictErr != nil && q.payloadStrictness == HTTPPayloadStrictnessError {
+			err = q.declineJob(ctx, buildJob, jobID, DeclineReasonUnknownPayloadFields)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "couldn't decline job")
+			}
+			return nil, nil, errors.Wrapf(httpJobDeclinedErr, "unknown payload fields: %v", strictErr)
+		}
+	}
+
+	if !q.repositoryPermitted(buildJob.payload.Data.Repository.Slug) {
+		err = q.declineJob(ctx, buildJob, jobID, DeclineReasonRepositoryNotPermitted)
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "couldn't delete job")
+			return nil, nil, errors.Wrap(err, "couldn't decline job")
 		}
-		return nil, nil, errors.Wrap(err, "payload JSON parse error")
+		return nil, nil, errors.Wrapf(httpJobDeclinedErr, "repository %q not permitted", buildJob.payload.Data.Repository.Slug)
 	}
 
-	err = json.Unmarshal(body, &startAttrs)
-	if err != nil {
-		logger.WithField("err", err).Error("start attributes JSON parse error, attempting to delete job")
-		err := q.deleteJob(ctx, jobID)
+	if q.requireVMType && buildJob.payload.Data.VMType == "" {
+		err = q.declineJob(ctx, buildJob, jobID, DeclineReasonMissingVMType)
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "couldn't delete job")
+			return nil, nil, errors.Wrap(err, "couldn't decline job")
 		}
-		return nil, nil, errors.Wrap(err, "start attributes JSON parse error")
+		return nil, nil, errors.Wrap(httpJobDeclinedErr, "missing vm type")
 	}
 
-	rawPayload, err := simplejson.NewJson(body)
-	if err != nil {
-		logger.WithField("err", err).Error("raw payload JSON parse error, attempting to delete job")
-		err := q.deleteJob(ctx, jobID)
+	if !q.supportsVMType(buildJob.startAttributes.VMType) {
+		err = q.declineJob(ctx, buildJob, jobID, DeclineReasonUnsupportedVMType)
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "couldn't delete job")
+			return nil, nil, errors.Wrap(err, "couldn't decline job")
 		}
-		return nil, nil, errors.Wrap(err, "raw payload JSON parse error")
+		return nil, nil, errors.Wrapf(httpJobDeclinedErr, "unsupported vm type %q", buildJob.startAttributes.VMType)
 	}
-	buildJob.rawPayload = rawPayload.Get("data")
 
-	buildJob.startAttributes = startAttrs.Data.Config
-	buildJob.startAttributes.VMConfig = buildJob.payload.Data.VMConfig
-	buildJob.startAttributes.VMType = buildJob.payload.Data.VMType
-	buildJob.startAttributes.SetDefaults(q.DefaultLanguage, q.DefaultDist, q.DefaultGroup, q.DefaultOS, VMTypeDefault, VMConfigDefault)
+	logger.WithFields(logrus.Fields{
+		"job_id":           jobID,
+		"start_attributes": startAttributesFields(buildJob.startAttributes),
+	}).Debug("resolved start attributes")
 
 	return buildJob, readyChan, nil
 }
 
+// startAttributesFields returns the resolved start attributes of a job for
+// logging.  The fields are listed explicitly rather than marshalled, so that
+// nothing is logged that hasn't been vetted for secrets.
+func startAttributesFields(sa *backend.StartAttributes) logrus.Fields {
+	return logrus.Fields{
+		"language":   sa.Language,
+		"osx_image":  sa.OsxImage,
+		"dist":       sa.Dist,
+		"group":      sa.Group,
+		"os":         sa.OS,
+		"image_name": sa.ImageName,
+		"vm_type":    sa.VMType,
+		"vm_config": logrus.Fields{
+			"gpu_count": sa.VMConfig.GpuCount,
+			"gpu_type":  sa.VMConfig.GpuType,
+			"zone":      sa.VMConfig.Zone,
+		},
+		"warmer": sa.Warmer,
+	}
+}
+
+// repositoryPermitted checks the given repository slug against the
+// configured repository deny and allow lists.
+func (q *HTTPJobQueue) repositoryPermitted(slug string) bool {
+	for _, pattern := range q.repositoryDenyList {
+		if matched, _ := path.Match(pattern, slug); matched {
+			return false
+		}
+	}
+
+	if len(q.repositoryAllowList) == 0 {
+		return true
+	}
+
+	for _, pattern := range q.repositoryAllowList {
+		if matched, _ := path.Match(pattern, slug); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// declineJob hands a fetched job back without running it by requeueing it and
+// then deleting it from job-board, so that another worker may pick it up.
+func (q *HTTPJobQueue) declineJob(ctx gocontext.Context, buildJob *httpJob, jobID uint64, reason DeclineReason) error {
+	context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"self":   "http_job_queue",
+		"job_id": jobID,
+		"reason": reason,
+	}).Info("declining job")
+
+	q.markReason("declined", string(reason))
+	q.recordDrop(ctx, jobID, string(reason))
+
+	ctx = context.FromJWT(ctx, buildJob.payload.JWT)
+
+	err := buildJob.Requeue(ctx)
+	if err != nil {
+		return errors.Wrap(err, "couldn't requeue job")
+	}
+
+	return q.deleteJob(ctx, jobID)
+}
+
 func (q *HTTPJobQueue) generateJobRefreshClaimFunc(jobID uint64) (func(gocontext.Context), <-chan struct{}) {
 	readyChan := make(chan struct{})
 
@@ -503,7 +1883,7 @@ func (q *HTTPJobQueue) generateJobRefreshClaimFunc(jobID uint64) (func(gocontext
 					"err":    err,
 					"job_id": jobID,
 				}).Error("cancelling")
-				q.cb.Broadcast(jobID)
+				q.cb.BroadcastReason(jobID, CancellationReasonClaimLost)
 				return
 			}
 
@@ -516,18 +1896,1030 @@ func (q *HTTPJobQueue) generateJobRefreshClaimFunc(jobID uint64) (func(gocontext
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(refreshClaimInterval):
+			case <-q.clock.After(q.claimRefreshInterval(refreshClaimInterval)):
 			}
 		}
 	}, (<-chan struct{})(readyChan)
 }
 
-// Name returns the name of this queue type, wow!
-func (q *HTTPJobQueue) Name() string {
-	return "http"
+// claimRefreshInterval returns the interval until the claim of a running job
+// is next refreshed, which is the interval given by job-board, shortened to
+// the heartbeat interval, if any.
+func (q *HTTPJobQueue) claimRefreshInterval(refreshClaimInterval time.Duration) time.Duration {
+	if q.heartbeatInterval > 0 && q.heartbeatInterval < refreshClaimInterval {
+		return q.heartbeatInterval
+	}
+	return refreshClaimInterval
 }
 
-// Cleanup does not do anything!
-func (q *HTTPJobQueue) Cleanup() error {
+// resolveURL returns a copy of the job-board URL to make a request against,
+// which is supplied by the URL resolver, if any.
+func (q *HTTPJobQueue) resolveURL(ctx gocontext.Context) (url.URL, error) {
+	if q.urlResolver == nil {
+		return *q.jobBoardURL, nil
+	}
+
+	u, err := q.urlResolver(ctx)
+	if err != nil {
+		q.mark("url_resolver_error")
+		return url.URL{}, errors.Wrap(err, "couldn't resolve job-board URL")
+	}
+	if u == nil {
+		q.mark("url_resolver_error")
+		return url.URL{}, errors.New("couldn't resolve job-board URL; resolver returned nil")
+	}
+	return *u, nil
+}
+
+// validateHealthProbePath checks that the given health probe path is an
+// absolute, clean path without a query or fragment, so that it can only
+// replace the path of the job-board URL.
+func validateHealthProbePath(probePath string) error {
+	u, err := url.Parse(probePath)
+	if err != nil {
+		return errors.Wrapf(err, "invalid health probe path %q", probePath)
+	}
+	if u.Scheme != "" || u.Host != "" || strings.ContainsAny(probePath, "?#") {
+		return errors.Errorf("health probe path %q must be a path without a host, query or fragment", probePath)
+	}
+	if !strings.HasPrefix(u.Path, "/") || path.Clean(u.Path) != u.Path {
+		return errors.Errorf("health probe path %q must be an absolute, clean path", probePath)
+	}
+	return nil
+}
+
+// Ping checks that job-board is reachable by requesting the health probe
+// path with HEAD.  Any response below 500 counts as reachable, as the
+// default path of /jobs doesn't support HEAD.
+func (q *HTTPJobQueue) Ping(ctx gocontext.Context) error {
+	logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"self": "http_job_queue",
+	})
+
+	u, err := q.resolveURL(ctx)
+	if err != nil {
+		return err
+	}
+	u.Path = q.healthProbePath
+	u.User = nil
+
+	req, err := http.NewRequest("HEAD", u.String(), nil)
+	if err != nil {
+		return errors.Wrap(err, "couldn't create health probe request")
+	}
+
+	req.Header.Add("Travis-Site", q.site)
+
+	logger.WithField("url", u.String()).Debug("performing HEAD request")
+
+	resp, err := q.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		q.mark("ping_error")
+		return errors.Wrap(err, "failed to probe job-board health")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		q.mark("ping_error")
+		return errors.Errorf("job-board health probe responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkRedirect re-applies the job-board headers of the original request to a
+// redirected request, as proxies in front of job-board may issue redirects
+// that would otherwise lose them.  Credentials, including basic auth given in
+// the job-board URL, are only re-applied when redirected to the same host.
+func (q *HTTPJobQueue) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	orig := via[0]
+	for _, key := range []string{"Travis-Site", "Travis-Infrastructure", "From", "Content-Type"} {
+		if req.Header.Get(key) == "" && orig.Header.Get(key) != "" {
+			req.Header.Set(key, orig.Header.Get(key))
+		}
+	}
+
+	if req.URL.Host != orig.URL.Host {
+		return nil
+	}
+
+	if req.Header.Get("Authorization") == "" && orig.Header.Get("Authorization") != "" {
+		req.Header.Set("Authorization", orig.Header.Get("Authorization"))
+	}
+	if req.URL.User == nil && orig.URL.User != nil {
+		req.URL.User = orig.URL.User
+	}
+
+	return nil
+}
+
+// checkJobResponse guards against a job-board job response without a body,
+// which is never retried, as a transport returning one is broken rather than
+// failing transiently.
+func checkJobResponse(resp *http.Response) error {
+	if resp == nil || resp.Body == nil {
+		return &httpJobQueuePermanentError{err: errors.New("no response body from job-board job request")}
+	}
+	return nil
+}
+
+// httpJobQueuePermanentError wraps an error that retrying won't resolve, so
+// that retry returns it right away.
+type httpJobQueuePermanentError struct {
+	err error
+}
+
+func (e *httpJobQueuePermanentError) Error() string {
+	return e.err.Error()
+}
+
+// retry calls the given operation until it succeeds, backing off
+// exponentially between attempts up to the configured retry limits.  An
+// *httpJobQueuePermanentError stops retrying, and the error it wraps is
+// returned.  Retrying also stops once the given context is done, returning the
+// context's error, although the first attempt is always made.
+func (q *HTTPJobQueue) retry(ctx gocontext.Context, op func() error) error {
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxInterval = q.retryMaxInterval
+	bo.MaxElapsedTime = q.retryMaxElapsedTime
+	bo.Clock = q.clock
+
+	var b backoff.BackOff = bo
+	if q.maxRetries > 0 {
+		b = backoff.WithMaxRetries(bo, uint64(q.maxRetries))
+	}
+	b.Reset()
+
+	for {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if permanentErr, ok := err.(*httpJobQueuePermanentError); ok {
+			return permanentErr.err
+		}
+
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			return err
+		}
+		select {
+		case <-q.clock.After(next):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// trackUnackedJob records that the given job has been fetched from job-board
+// but not yet acknowledged as started by a processor, and that its payload is
+// buffered until then.
+func (q *HTTPJobQueue) trackUnackedJob(jobID uint64, payloadBytes int) {
+	q.unackedJobsMutex.Lock()
+	defer q.unackedJobsMutex.Unlock()
+
+	q.removeUnackedJob(jobID)
+	q.unackedJobs[jobID] = &httpUnackedJob{
+		fetchedAt:    q.clock.Now(),
+		payloadBytes: int64(payloadBytes),
+	}
+	q.unackedPayloadBytes += int64(payloadBytes)
+	q.gauge("unacked", int64(len(q.unackedJobs)))
+	q.gauge("buffered_payload_bytes", q.unackedPayloadBytes)
+}
+
+// removeUnackedJob removes the given job from the unacknowledged jobs,
+// returning it if it was present.  The unackedJobsMutex must be held by the
+// caller.
+func (q *HTTPJobQueue) removeUnackedJob(jobID uint64) (*httpUnackedJob, bool) {
+	unacked, ok := q.unackedJobs[jobID]
+	if !ok {
+		return nil, false
+	}
+
+	delete(q.unackedJobs, jobID)
+	q.unackedPayloadBytes -= unacked.payloadBytes
+	q.gauge("unacked", int64(len(q.unackedJobs)))
+	q.gauge("buffered_payload_bytes", q.unackedPayloadBytes)
+	return unacked, true
+}
+
+// queueDepth returns the number of jobs fetched but not yet started by a
+// processor.
+func (q *HTTPJobQueue) queueDepth() int {
+	q.unackedJobsMutex.Lock()
+	defer q.unackedJobsMutex.Unlock()
+
+	return len(q.unackedJobs)
+}
+
+// payloadBudgetExceeded returns whether the payloads of unacknowledged jobs
+// exceed the buffered payload budget.
+func (q *HTTPJobQueue) payloadBudgetExceeded() bool {
+	if q.maxBufferedPayloadBytes <= 0 {
+		return false
+	}
+
+	q.unackedJobsMutex.Lock()
+	defer q.unackedJobsMutex.Unlock()
+
+	return q.unackedPayloadBytes >= q.maxBufferedPayloadBytes
+}
+
+// ackJob is invoked via the job once a processor has begun running it, which
+// closes the gap between a job being fetched and a job being started.
+func (q *HTTPJobQueue) ackJob(ctx gocontext.Context, jobID uint64) {
+	q.unackedJobsMutex.Lock()
+	defer q.unackedJobsMutex.Unlock()
+
+	unacked, ok := q.removeUnackedJob(jobID)
+	if !ok {
+		return
+	}
+
+	q.timeSince("ack_time", unacked.fetchedAt)
+
+	context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"self":   "http_job_queue",
+		"job_id": jobID,
+	}).Debug("job acknowledged by processor")
+}
+
+// dropUnackedJob marks the given job as dropped for the given reason if it was
+// fetched but never acknowledged as started by a processor.
+func (q *HTTPJobQueue) dropUnackedJob(ctx gocontext.Context, jobID uint64, reason string) {
+	q.unackedJobsMutex.Lock()
+	defer q.unackedJobsMutex.Unlock()
+
+	unacked, ok := q.removeUnackedJob(jobID)
+	if !ok {
+		return
+	}
+
+	q.mark("dropped")
+
+	context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"self":          "http_job_queue",
+		"job_id":        jobID,
+		"since_fetch_s": q.clock.Now().Sub(unacked.fetchedAt).Seconds(),
+	}).Warn("job fetched but never started")
+
+	q.recordDrop(ctx, jobID, reason)
+}
+
+// recordDrop records that the given fetched job won't be run, for the given
+// reason, as a log line, a metric and a trace span, and keeps it among the
+// recent drops reported in the status.
+func (q *HTTPJobQueue) recordDrop(ctx gocontext.Context, jobID uint64, reason string) {
+	drop := HTTPJobQueueDrop{
+		JobID:  jobID,
+		Reason: reason,
+		At:     q.clock.Now().UTC(),
+	}
+
+	_, span := trace.StartSpan(ctx, "HTTPJobQueue.recordDrop")
+	span.AddAttributes(
+		trace.Int64Attribute("job_id", int64(jobID)),
+		trace.StringAttribute("reason", reason),
+	)
+	span.End()
+
+	q.markReason("not_dispatched", reason)
+
+	context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"self":   "http_job_queue",
+		"job_id": jobID,
+		"reason": reason,
+	}).Info("job not dispatched")
+
+	q.statusMutex.Lock()
+	defer q.statusMutex.Unlock()
+
+	if len(q.drops) < httpJobQueueMaxDrops {
+		q.drops = append(q.drops, drop)
+		return
+	}
+	q.drops[q.nextDrop] = drop
+	q.nextDrop = (q.nextDrop + 1) % httpJobQueueMaxDrops
+}
+
+// Status returns a snapshot of the current state of the queue.
+func (q *HTTPJobQueue) Status() HTTPJobQueueStatus {
+	q.statusMutex.Lock()
+	status := HTTPJobQueueStatus{
+		LastPollAt:     q.lastPollAt,
+		LastErrorAt:    q.lastErrAt,
+		JobsFetched:    q.jobsFetched,
+		JobsDispatched: q.jobsDispatched,
+		PollMode:       HTTPPollModeNormal,
+		LoadShedding:   q.loadShedding,
+	}
+	if q.lastErr != nil {
+		status.LastError = q.lastErr.Error()
+	}
+	if q.clock.Now().Before(q.recoveryUntil) {
+		status.PollMode = HTTPPollModeRecovery
+	}
+	status.PollInterval = q.effectivePollInterval().String()
+	status.RecentDrops = append(append([]HTTPJobQueueDrop{}, q.drops[q.nextDrop:]...), q.drops[:q.nextDrop]...)
+	q.statusMutex.Unlock()
+
+	if capacity, poolSize, ok := q.capacity(); ok {
+		status.Capacity = capacity
+		status.PoolSize = poolSize
+		if status.PoolSize > 0 {
+			status.Utilization = float64(status.PoolSize-capacity) / float64(status.PoolSize)
+		}
+	}
+	status.RunningJobIDs = q.RunningJobIDs()
+
+	q.unackedJobsMutex.Lock()
+	status.Unacked = len(q.unackedJobs)
+	status.BufferedPayloadBytes = q.unackedPayloadBytes
+	q.unackedJobsMutex.Unlock()
+
+	q.provisioningMutex.Lock()
+	status.Provisioning = len(q.provisioningJobs)
+	q.provisioningMutex.Unlock()
+
+	q.fetchFailuresMutex.Lock()
+	q.expireFetchFailures()
+	status.Deadlettered = len(q.deadletteredJobs)
+	q.fetchFailuresMutex.Unlock()
+
+	return status
+}
+
+func (q *HTTPJobQueue) recordPoll(at time.Time) {
+	q.statusMutex.Lock()
+	defer q.statusMutex.Unlock()
+
+	q.lastPollAt = at
+}
+
+func (q *HTTPJobQueue) recordError(err error) {
+	q.statusMutex.Lock()
+	defer q.statusMutex.Unlock()
+
+	q.lastErr = err
+	q.lastErrAt = q.clock.Now()
+
+	if q.quietPeriodErrors <= 0 || q.lastErrAt.Before(q.recoveryUntil) {
+		return
+	}
+
+	recentErrors := []time.Time{}
+	for _, at := range q.recentErrors {
+		if q.lastErrAt.Sub(at) < q.quietPeriodWindow {
+			recentErrors = append(recentErrors, at)
+		}
+	}
+	q.recentErrors = append(recentErrors, q.lastErrAt)
+
+	if len(q.recentErrors) < q.quietPeriodErrors {
+		return
+	}
+
+	q.recentErrors = nil
+	q.recoveryUntil = q.lastErrAt.Add(q.quietPeriodDuration)
+	q.mark("quiet_period")
+
+	context.LoggerFromContext(gocontext.Background()).WithFields(logrus.Fields{
+		"self":     "http_job_queue",
+		"errors":   q.quietPeriodErrors,
+		"window":   q.quietPeriodWindow,
+		"interval": q.quietPeriodInterval,
+		"until":    q.recoveryUntil,
+	}).Warn("entering quiet period after burst of errors")
+}
+
+// shedLoad checks the resource monitor, if any, and returns whether the host
+// is under resource pressure.  Errors checking are logged and don't shed load.
+func (q *HTTPJobQueue) shedLoad(ctx gocontext.Context) bool {
+	if q.resourceMonitor == nil {
+		return false
+	}
+
+	logger := context.LoggerFromContext(ctx).WithField("self", "http_job_queue")
+
+	reason, shedding, err := q.resourceMonitor.UnderPressure()
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't check resource pressure")
+		q.mark("resource_monitor_error")
+		shedding = false
+	}
+
+	q.statusMutex.Lock()
+	defer q.statusMutex.Unlock()
+
+	if shedding && !q.loadShedding {
+		logger.WithField("reason", reason).Warn("shedding load under resource pressure")
+	} else if !shedding && q.loadShedding {
+		logger.Info("resource pressure subsided; no longer shedding load")
+	}
+	q.loadShedding = shedding
+
+	return shedding
+}
+
+func (q *HTTPJobQueue) sheddingLoad() bool {
+	q.statusMutex.Lock()
+	defer q.statusMutex.Unlock()
+
+	return q.loadShedding
+}
+
+// quietPollInterval returns the interval to wait for before the next poll,
+// which is the quiet period interval during a quiet period, unless the given
+// poll interval is longer.
+func (q *HTTPJobQueue) quietPollInterval(pollInterval time.Duration) time.Duration {
+	q.statusMutex.Lock()
+	defer q.statusMutex.Unlock()
+
+	if q.recoveryUntil.IsZero() {
+		return pollInterval
+	}
+
+	if !q.clock.Now().Before(q.recoveryUntil) {
+		q.recoveryUntil = time.Time{}
+		context.LoggerFromContext(gocontext.Background()).WithField("self", "http_job_queue").Info("quiet period over")
+		return pollInterval
+	}
+
+	if q.quietPeriodInterval > pollInterval {
+		return q.quietPeriodInterval
+	}
+	return pollInterval
+}
+
+func (q *HTTPJobQueue) recordPollInterval(pollInterval time.Duration) {
+	q.statusMutex.Lock()
+	q.currentPollInterval = pollInterval
+	q.statusMutex.Unlock()
+
+	q.gauge("poll_interval_ms", int64(pollInterval/time.Millisecond))
+}
+
+// CurrentPollInterval returns the interval most recently waited for between
+// polls, which differs from the configured poll interval where job-board
+// hints at another one, or during a quiet period.  It is the configured poll
+// interval until the first poll has completed.
+func (q *HTTPJobQueue) CurrentPollInterval() time.Duration {
+	q.statusMutex.Lock()
+	defer q.statusMutex.Unlock()
+
+	return q.effectivePollInterval()
+}
+
+// effectivePollInterval returns the current poll interval.  The statusMutex
+// must be held by the caller.
+func (q *HTTPJobQueue) effectivePollInterval() time.Duration {
+	if q.currentPollInterval == 0 {
+		return q.pollInterval
+	}
+	return q.currentPollInterval
+}
+
+func (q *HTTPJobQueue) recordFetched() {
+	q.statusMutex.Lock()
+	defer q.statusMutex.Unlock()
+
+	q.jobsFetched++
+}
+
+func (q *HTTPJobQueue) recordDispatched() {
+	q.statusMutex.Lock()
+	defer q.statusMutex.Unlock()
+
+	q.jobsDispatched++
+}
+
+// beginInFlight marks the given job ID as being fetched and dispatched by a
+// poller, unless another poller is already doing so.
+func (q *HTTPJobQueue) beginInFlight(jobID uint64) bool {
+	q.inFlightMutex.Lock()
+	defer q.inFlightMutex.Unlock()
+
+	if _, ok := q.inFlightJobs[jobID]; ok {
+		return false
+	}
+	q.inFlightJobs[jobID] = struct{}{}
+	return true
+}
+
+func (q *HTTPJobQueue) endInFlight(jobID uint64) {
+	q.inFlightMutex.Lock()
+	defer q.inFlightMutex.Unlock()
+
+	delete(q.inFlightJobs, jobID)
+}
+
+// trackDispatchedJob records the given job as dispatched to a processor until
+// it is finished, so that it may be handed back to job-board on shutdown.
+func (q *HTTPJobQueue) trackDispatchedJob(jobID uint64, buildJob Job) {
+	j, ok := buildJob.(*httpJob)
+	if !ok {
+		return
+	}
+
+	q.dispatchedJobsMutex.Lock()
+	q.dispatchedJobs[jobID] = j
+	q.dispatchedJobsMutex.Unlock()
+
+	q.saveStateOrWarn()
+}
+
+func (q *HTTPJobQueue) untrackDispatchedJob(jobID uint64) {
+	q.dispatchedJobsMutex.Lock()
+	delete(q.dispatchedJobs, jobID)
+	q.dispatchedJobsMutex.Unlock()
+
+	q.saveStateOrWarn()
+}
+
+// RunningJobIDs returns a snapshot of the IDs of the jobs processors are
+// currently running, in ascending order.  The returned slice is owned by the
+// caller.
+func (q *HTTPJobQueue) RunningJobIDs() []uint64 {
+	jobIDs := []uint64{}
+	processors := q.currentProcessors()
+	if processors == nil {
+		return jobIDs
+	}
+
+	processors.Each(func(_ int, p *Processor) {
+		status, lastJobID, _ := p.Status()
+		if status == "processing" && lastJobID != 0 {
+			jobIDs = append(jobIDs, lastJobID)
+		}
+	})
+	sort.Slice(jobIDs, func(i, j int) bool { return jobIDs[i] < jobIDs[j] })
+	return jobIDs
+}
+
+// RequeueRunningJobs hands every job processors are currently running back to
+// job-board, so that other workers pick them up right away rather than once
+// their claims have gone stale.  Each job is marked as handed back and its
+// processor told to cancel it before it is requeued, so that no state update
+// of its processor is sent from then on.  Processors should still be stopped
+// right after.
+func (q *HTTPJobQueue) RequeueRunningJobs(ctx gocontext.Context) error {
+	logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"self": "http_job_queue",
+		"inst": fmt.Sprintf("%p", q),
+	})
+
+	jobIDs := q.RunningJobIDs()
+	failed := 0
+	for _, jobID := range jobIDs {
+		q.dispatchedJobsMutex.Lock()
+		buildJob, ok := q.dispatchedJobs[jobID]
+		q.dispatchedJobsMutex.Unlock()
+
+		if !ok {
+			logger.WithField("job_id", jobID).Debug("running job not dispatched by this queue")
+			continue
+		}
+
+		logger.WithField("job_id", jobID).Info("requeueing running job on shutdown")
+		jobCtx := context.FromJWT(context.FromJobID(ctx, jobID), buildJob.payload.JWT)
+
+		buildJob.handBack()
+		if q.cb != nil {
+			q.cb.BroadcastReason(jobID, CancellationReasonHandedBack)
+		}
+
+		// NOTE: requeueing untracks the job, whether or not the state
+		// update is sent.
+		err := buildJob.requeueHandedBack(jobCtx)
+		if err == nil {
+			err = q.deleteJob(jobCtx, jobID)
+		}
+		if err != nil {
+			// NOTE: the job has been handed back regardless, so that it is
+			// picked up by another worker once its claim has gone stale.
+			logger.WithFields(logrus.Fields{
+				"err":    err,
+				"job_id": jobID,
+			}).Error("couldn't requeue running job on shutdown")
+			failed++
+			continue
+		}
+
+		q.markReason("requeued", "shutdown")
+	}
+
+	if failed > 0 {
+		return errors.Errorf("couldn't requeue %d of %d running jobs", failed, len(jobIDs))
+	}
+	return nil
+}
+
+// reserveProvisioning reserves a provisioning slot for a job about to be
+// fetched, returning false if the provisioning limit has been reached.  The
+// slot must be either released or handed to a job via beginProvisioning.
+func (q *HTTPJobQueue) reserveProvisioning() bool {
+	q.provisioningMutex.Lock()
+	defer q.provisioningMutex.Unlock()
+
+	if q.maxConcurrentProvisioning > 0 &&
+		q.provisioningReserved+len(q.provisioningJobs) >= q.maxConcurrentProvisioning {
+		return false
+	}
+
+	q.provisioningReserved++
+	return true
+}
+
+// releaseProvisioning releases a reserved provisioning slot that didn't end
+// up being used by a job.
+func (q *HTTPJobQueue) releaseProvisioning() {
+	q.provisioningMutex.Lock()
+	defer q.provisioningMutex.Unlock()
+
+	q.provisioningReserved--
+}
+
+// beginProvisioning hands a reserved provisioning slot to the given job.
+func (q *HTTPJobQueue) beginProvisioning(jobID uint64) {
+	q.provisioningMutex.Lock()
+	defer q.provisioningMutex.Unlock()
+
+	q.provisioningReserved--
+	q.provisioningJobs[jobID] = q.clock.Now()
+	q.gauge("provisioning", int64(len(q.provisioningJobs)))
+}
+
+// endProvisioning is invoked via the job once it has started, finished or
+// been requeued, which frees its provisioning slot.
+func (q *HTTPJobQueue) endProvisioning(jobID uint64) {
+	q.provisioningMutex.Lock()
+	defer q.provisioningMutex.Unlock()
+
+	beganAt, ok := q.provisioningJobs[jobID]
+	if !ok {
+		return
+	}
+
+	delete(q.provisioningJobs, jobID)
+	q.timeSince("provisioning_time", beganAt)
+	q.gauge("provisioning", int64(len(q.provisioningJobs)))
+}
+
+// recordFetchFailure counts a failure to fetch the given job, and deadletters
+// the job once it has failed to be fetched FetchFailureThreshold times in a
+// row, so that a single job that can't be fetched doesn't stall the worker.
+func (q *HTTPJobQueue) recordFetchFailure(ctx gocontext.Context, jobID uint64) {
+	q.fetchFailuresMutex.Lock()
+	q.expireFetchFailures()
+
+	failure, ok := q.fetchFailures[jobID]
+	if !ok {
+		failure = &httpFetchFailure{}
+		q.fetchFailures[jobID] = failure
+	}
+	failure.count++
+	failure.lastAt = q.clock.Now()
+
+	count := failure.count
+	if count >= q.fetchFailureThreshold {
+		delete(q.fetchFailures, jobID)
+		q.deadletteredJobs[jobID] = q.clock.Now().Add(q.deadletterTTL)
+	}
+	q.fetchFailuresMutex.Unlock()
+
+	if count < q.fetchFailureThreshold {
+		return
+	}
+
+	context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"self":     "http_job_queue",
+		"job_id":   jobID,
+		"failures": count,
+		"ttl":      q.deadletterTTL,
+	}).Error("deadlettering job after repeated fetch failures")
+	q.mark("deadlettered")
+	q.releaseDeadletteredJob(ctx, jobID)
+}
+
+// clearFetchFailures resets the fetch failure count of the given job after it
+// has been fetched successfully.
+func (q *HTTPJobQueue) clearFetchFailures(jobID uint64) {
+	q.fetchFailuresMutex.Lock()
+	defer q.fetchFailuresMutex.Unlock()
+
+	delete(q.fetchFailures, jobID)
+}
+
+// deadlettered returns whether the given job is currently deadlettered.
+func (q *HTTPJobQueue) deadlettered(jobID uint64) bool {
+	q.fetchFailuresMutex.Lock()
+	defer q.fetchFailuresMutex.Unlock()
+
+	q.expireFetchFailures()
+	_, ok := q.deadletteredJobs[jobID]
+	return ok
+}
+
+// expireFetchFailures removes deadlettered jobs whose TTL has passed, along
+// with fetch failures that haven't recurred within the TTL.  The
+// fetchFailuresMutex must be held by the caller.
+func (q *HTTPJobQueue) expireFetchFailures() {
+	now := q.clock.Now()
+	for jobID, expiresAt := range q.deadletteredJobs {
+		if now.After(expiresAt) {
+			delete(q.deadletteredJobs, jobID)
+		}
+	}
+	for jobID, failure := range q.fetchFailures {
+		if now.Sub(failure.lastAt) > q.deadletterTTL {
+			delete(q.fetchFailures, jobID)
+		}
+	}
+}
+
+// releaseDeadletteredJob hands the given deadlettered job back to job-board
+// by deleting this worker's reservation of it, so that job-board may offer it
+// to another worker rather than to this one again.  This is best-effort, as
+// the job is skipped for the deadletter TTL either way.
+func (q *HTTPJobQueue) releaseDeadletteredJob(ctx gocontext.Context, jobID uint64) {
+	err := q.deleteJob(ctx, jobID)
+	if err != nil {
+		context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"self":   "http_job_queue",
+			"job_id": jobID,
+			"err":    err,
+		}).Warn("couldn't release deadlettered job")
+	}
+}
+
+// metricNames returns the full names of the given http job queue metric, both
+// undimensioned and dimensioned by provider and site, e.g.
+// "travis.worker.job_queue.http.gce.org.blocking_time", as the metrics
+// backend has no support for tags.
+func (q *HTTPJobQueue) metricNames(name string) []string {
+	return []string{
+		fmt.Sprintf("travis.worker.job_queue.http.%s", name),
+		q.siteMetricName(q.site, name),
+	}
+}
+
+// siteMetricName returns the full name of the given http job queue metric
+// dimensioned by provider and the given site.
+func (q *HTTPJobQueue) siteMetricName(site, name string) string {
+	providerName := q.providerName
+	if providerName == "" {
+		providerName = "unknown"
+	}
+	if site == "" {
+		site = "unknown"
+	}
+
+	return fmt.Sprintf("travis.worker.job_queue.http.%s.%s.%s", providerName, site, name)
+}
+
+func (q *HTTPJobQueue) mark(name string) {
+	for _, n := range q.metricNames(name) {
+		metrics.Mark(n)
+	}
+	if q.prometheus != nil {
+		q.prometheus.mark(name)
+	}
+}
+
+// markReason reports an event along with why it happened, so that every
+// reason is counted by the same metric.  The reason is a label of the
+// Prometheus metric, and a dimension of the Librato metric, which is reported
+// in addition to the undimensioned one.
+func (q *HTTPJobQueue) markReason(name, reason string) {
+	for _, n := range append(q.metricNames(name), q.metricNames(name+"."+reason)...) {
+		metrics.Mark(n)
+	}
+	if q.prometheus != nil {
+		q.prometheus.markReason(name, reason)
+	}
+}
+
+func (q *HTTPJobQueue) timeSince(name string, since time.Time) {
+	duration := q.clock.Now().Sub(since)
+	for _, n := range q.metricNames(name) {
+		metrics.TimeDuration(n, duration)
+	}
+	if q.prometheus != nil {
+		q.prometheus.timeDuration(name, duration)
+	}
+}
+
+// siteMark and siteTimeSince report metrics for a single site, which are
+// only dimensioned by site.
+func (q *HTTPJobQueue) siteMark(site, name string) {
+	metrics.Mark(q.siteMetricName(site, name))
+	if q.prometheus != nil {
+		q.prometheus.siteMark(site, name)
+	}
+}
+
+func (q *HTTPJobQueue) siteTimeSince(site, name string, since time.Time) {
+	duration := q.clock.Now().Sub(since)
+	metrics.TimeDuration(q.siteMetricName(site, name), duration)
+	if q.prometheus != nil {
+		q.prometheus.siteTimeDuration(site, name, duration)
+	}
+}
+
+func (q *HTTPJobQueue) gauge(name string, value int64) {
+	for _, n := range q.metricNames(name) {
+		metrics.Gauge(n, value)
+	}
+	if q.prometheus != nil {
+		q.prometheus.gauge(name, value)
+	}
+}
+
+// SetProcessors replaces the processors the queue reports capacity for and
+// checks VM type support against, e.g. when the pool has been recreated.  A
+// nil pointer is treated like nil, i.e. capacity is no longer reported.
+func (q *HTTPJobQueue) SetProcessors(processors ProcessorEacherSizer) {
+	if isNilProcessors(processors) {
+		processors = nil
+	}
+
+	q.processorsMutex.Lock()
+	defer q.processorsMutex.Unlock()
+
+	q.processors = processors
+}
+
+func (q *HTTPJobQueue) currentProcessors() ProcessorEacherSizer {
+	q.processorsMutex.RLock()
+	defer q.processorsMutex.RUnlock()
+
+	return q.processors
+}
+
+// capacity returns the number of jobs this worker is able to start right
+// away, along with the pool size, if known.  This is the number of processors
+// that are new or waiting for a job rather than the pool size, as processors
+// that are busy can't take on another job.  While shedding load, no processor
+// is ready.
+func (q *HTTPJobQueue) capacity() (int, int, bool) {
+	processors := q.currentProcessors()
+	if processors == nil {
+		return 0, 0, false
+	}
+	if q.sheddingLoad() {
+		return 0, processors.Size(), true
+	}
+
+	ready := 0
+	processors.Each(func(_ int, p *Processor) {
+		if q.processorReady(p) {
+			ready++
+		}
+	})
+	return ready, processors.Size(), true
+}
+
+// processorReady returns whether the given processor is waiting for a job,
+// and has been for at least the idle grace window.  A processor that hasn't
+// run a job yet is "new" rather than "waiting", but is just as ready.
+func (q *HTTPJobQueue) processorReady(p *Processor) bool {
+	status, _, idleSince := p.Status()
+	if status != "new" && status != "waiting" {
+		return false
+	}
+	// NOTE: idleSince is stamped by the processor with the wall clock rather
+	// than the queue's clock, so it is compared against the wall clock too.
+	return q.idleGraceWindow <= 0 || time.Since(idleSince) >= q.idleGraceWindow
+}
+
+// clampCapacity caps the given capacity at the maximum advertised capacity,
+// if any, logging whenever capping starts or stops.
+func (q *HTTPJobQueue) clampCapacity(ctx gocontext.Context, capacity int) int {
+	if q.maxAdvertisedCapacity <= 0 {
+		return capacity
+	}
+
+	clamped := capacity > q.maxAdvertisedCapacity
+
+	q.statusMutex.Lock()
+	changed := clamped != q.capacityClamped
+	q.capacityClamped = clamped
+	q.statusMutex.Unlock()
+
+	logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"self":         "http_job_queue",
+		"capacity":     capacity,
+		"max_capacity": q.maxAdvertisedCapacity,
+	})
+
+	if !clamped {
+		if changed {
+			logger.Info("capacity no longer capped")
+		}
+		return capacity
+	}
+
+	if changed {
+		logger.Warn("capping capacity sent to job-board")
+	}
+	q.mark("capacity_clamped")
+	return q.maxAdvertisedCapacity
+}
+
+// readyVMTypes returns the VM types supported by the provider while at least
+// one processor is ready for a job, so that job-board may only offer jobs that
+// can be started right away.  Every processor in the pool shares the
+// provider, so any ready processor can run any of them.
+func (q *HTTPJobQueue) readyVMTypes() []string {
+	vmTypes := []string{}
+	processors := q.currentProcessors()
+	if processors == nil {
+		return vmTypes
+	}
+
+	ready := false
+	processors.Each(func(_ int, p *Processor) {
+		ready = ready || q.processorReady(p)
+	})
+	if !ready {
+		return vmTypes
+	}
+
+	for _, vmType := range []string{VMTypeDefault, VMTypePremium} {
+		if q.supportsVMType(vmType) {
+			vmTypes = append(vmTypes, vmType)
+		}
+	}
+
+	return vmTypes
+}
+
+// supportsVMType returns whether a job of the given VM type can be run by
+// this worker, which depends on its provider.
+func (q *HTTPJobQueue) supportsVMType(vmType string) bool {
+	return q.provider == nil || q.provider.SupportsVMType(vmType)
+}
+
+// infrastructureName returns the infrastructure reported to job-board.  A
+// provider may span multiple infrastructures (as is expected with the future
+// cloudbrain provider), so the provider name is only used as a fallback.
+func (q *HTTPJobQueue) infrastructureName() string {
+	if q.infrastructure != "" {
+		return q.infrastructure
+	}
+	return q.providerName
+}
+
+// Name returns the name of this queue type, wow!
+func (q *HTTPJobQueue) Name() string {
+	return "http"
+}
+
+// HTTPJobQueueCleanupError is returned by Cleanup when any of its teardown
+// steps fail, and holds the error of each step that failed.
+type HTTPJobQueueCleanupError struct {
+	Errors []error
+}
+
+func (e *HTTPJobQueueCleanupError) Error() string {
+	msgs := []string{}
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("couldn't clean up http job queue: %s", strings.Join(msgs, "; "))
+}
+
+// Cleanup stops polling, waits for every poll loop to exit, and then saves the
+// state file and closes the http recorder, if any.  Every step is attempted,
+// and the errors of those that failed are returned together as an
+// *HTTPJobQueueCleanupError.
+func (q *HTTPJobQueue) Cleanup() error {
+	q.lifecycleMutex.Lock()
+	select {
+	case <-q.done:
+	default:
+		close(q.done)
+	}
+	q.lifecycleMutex.Unlock()
+
+	q.pollers.Wait()
+
+	errs := []error{}
+	if err := q.saveState(); err != nil {
+		errs = append(errs, err)
+	}
+	if q.recorder != nil {
+		if err := q.recorder.Close(); err != nil {
+			errs = append(errs, errors.Wrap(err, "couldn't close http recorder"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return &HTTPJobQueueCleanupError{Errors: errs}
+	}
 	return nil
 }
@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// httpJobQueuePrometheusMetrics mirrors the metrics of an HTTPJobQueue as
+// Prometheus collectors, so that they can be scraped in addition to being
+// sent to Librato.  Each metric is labelled by its name as well as the
+// provider and site of the queue, and events are also labelled by their
+// reason, if any.
+type httpJobQueuePrometheusMetrics struct {
+	providerName string
+	site         string
+
+	events    *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+	gauges    *prometheus.GaugeVec
+}
+
+func newHTTPJobQueuePrometheusMetrics(registerer prometheus.Registerer, providerName, site string) (*httpJobQueuePrometheusMetrics, error) {
+	if providerName == "" {
+		providerName = "unknown"
+	}
+	if site == "" {
+		site = "unknown"
+	}
+
+	labels := []string{"name", "provider", "site"}
+	eventLabels := []string{"name", "reason", "provider", "site"}
+	m := &httpJobQueuePrometheusMetrics{
+		providerName: providerName,
+		site:         site,
+
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "travis_worker",
+			Subsystem: "job_queue_http",
+			Name:      "events_total",
+			Help:      "Number of events, such as poll outcomes, in the http job queue.",
+		}, eventLabels),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "travis_worker",
+			Subsystem: "job_queue_http",
+			Name:      "duration_seconds",
+			Help:      "Duration of operations, such as job fetches, in the http job queue.",
+		}, labels),
+		gauges: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "travis_worker",
+			Subsystem: "job_queue_http",
+			Name:      "gauge",
+			Help:      "Current values, such as capacity, of the http job queue.",
+		}, labels),
+	}
+
+	for _, c := range []prometheus.Collector{m.events, m.durations, m.gauges} {
+		err := registerer.Register(c)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't register prometheus collector")
+		}
+	}
+
+	return m, nil
+}
+
+func (m *httpJobQueuePrometheusMetrics) mark(name string) {
+	m.events.WithLabelValues(name, "", m.providerName, m.site).Inc()
+}
+
+func (m *httpJobQueuePrometheusMetrics) markReason(name, reason string) {
+	m.events.WithLabelValues(name, reason, m.providerName, m.site).Inc()
+}
+
+func (m *httpJobQueuePrometheusMetrics) timeDuration(name string, duration time.Duration) {
+	m.durations.WithLabelValues(name, m.providerName, m.site).Observe(duration.Seconds())
+}
+
+func (m *httpJobQueuePrometheusMetrics) siteMark(site, name string) {
+	m.events.WithLabelValues(name, "", m.providerName, site).Inc()
+}
+
+func (m *httpJobQueuePrometheusMetrics) siteTimeDuration(site, name string, duration time.Duration) {
+	m.durations.WithLabelValues(name, m.providerName, site).Observe(duration.Seconds())
+}
+
+func (m *httpJobQueuePrometheusMetrics) gauge(name string, value int64) {
+	m.gauges.WithLabelValues(name, m.providerName, m.site).Set(float64(value))
+}
@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPJobQueue_PrometheusMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	hjq, err := NewHTTPJobQueueWithConfig(&HTTPJobQueueConfig{
+		Site:                 "test",
+		ProviderName:         "fake",
+		PrometheusRegisterer: registry,
+	}, nil)
+	assert.Nil(t, err)
+
+	hjq.markReason("declined", "wat")
+	hjq.timeSince("fetch_job_time", time.Now().Add(-time.Second))
+	hjq.gauge("capacity", 2)
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	found := map[string]map[string]string{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			found[family.GetName()] = labels
+		}
+	}
+
+	for _, name := range []string{
+		"travis_worker_job_queue_http_events_total",
+		"travis_worker_job_queue_http_duration_seconds",
+		"travis_worker_job_queue_http_gauge",
+	} {
+		assert.Contains(t, found, name)
+		assert.Equal(t, "fake", found[name]["provider"])
+		assert.Equal(t, "test", found[name]["site"])
+	}
+	assert.Equal(t, "declined", found["travis_worker_job_queue_http_events_total"]["name"])
+	assert.Equal(t, "wat", found["travis_worker_job_queue_http_events_total"]["reason"])
+	assert.Equal(t, "capacity", found["travis_worker_job_queue_http_gauge"]["name"])
+}
+
+func TestHTTPJobQueue_PrometheusMetrics_AlreadyRegistered(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	_, err := NewHTTPJobQueueWithConfig(&HTTPJobQueueConfig{PrometheusRegisterer: registry}, nil)
+	assert.Nil(t, err)
+
+	_, err = NewHTTPJobQueueWithConfig(&HTTPJobQueueConfig{PrometheusRegisterer: registry}, nil)
+	assert.NotNil(t, err)
+}
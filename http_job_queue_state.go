@@ -0,0 +1,246 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	gocontext "context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/travis-ci/worker/context"
+)
+
+const (
+	httpJobQueueStateVersion = 1
+
+	// httpJobQueueStateMaxAge is the age after which a state file is ignored,
+	// as the claims of the jobs in it have long expired by then.
+	httpJobQueueStateMaxAge = time.Hour
+)
+
+// httpJobQueueState is what an HTTPJobQueue persists to its state file: the
+// jobs it had dispatched at the time, along with the job-board and queue they
+// were dispatched from.  The jobs include their JWTs, which are bearer tokens
+// for job-board, so the file is only readable by its owner.
+type httpJobQueueState struct {
+	Version int                     `json:"version"`
+	SavedAt time.Time               `json:"saved_at"`
+	Config  httpJobQueueStateConfig `json:"config"`
+	Jobs    []httpJobQueueStateJob  `json:"jobs"`
+}
+
+// httpJobQueueStateConfig identifies the job-board and queue a state file
+// belongs to, so that state isn't recovered against a different job-board.
+type httpJobQueueStateConfig struct {
+	JobBoardHost string   `json:"job_board_host"`
+	Queue        string   `json:"queue"`
+	Sites        []string `json:"sites"`
+}
+
+// httpJobQueueStateJob is what is needed to hand a dispatched job back to
+// job-board after a restart.
+type httpJobQueueStateJob struct {
+	ID          uint64 `json:"id"`
+	JWT         string `json:"jwt"`
+	JobStateURL string `json:"job_state_url"`
+	Site        string `json:"site"`
+}
+
+func (q *HTTPJobQueue) stateConfig() httpJobQueueStateConfig {
+	cfg := httpJobQueueStateConfig{
+		Queue: q.queue,
+		Sites: q.sites,
+	}
+	if q.jobBoardURL != nil {
+		cfg.JobBoardHost = q.jobBoardURL.Host
+	}
+	return cfg
+}
+
+// saveState writes the dispatched jobs to the state file, if any, whenever a
+// job is dispatched or finished.  The file is replaced atomically, so that a
+// crash mid-write doesn't corrupt it, and is created with 0600 permissions.
+func (q *HTTPJobQueue) saveState() error {
+	if q.statePath == "" {
+		return nil
+	}
+
+	q.stateMutex.Lock()
+	defer q.stateMutex.Unlock()
+
+	state := &httpJobQueueState{
+		Version: httpJobQueueStateVersion,
+		SavedAt: q.clock.Now().UTC(),
+		Config:  q.stateConfig(),
+		Jobs:    []httpJobQueueStateJob{},
+	}
+
+	q.dispatchedJobsMutex.Lock()
+	for jobID, buildJob := range q.dispatchedJobs {
+		state.Jobs = append(state.Jobs, httpJobQueueStateJob{
+			ID:          jobID,
+			JWT:         buildJob.payload.JWT,
+			JobStateURL: buildJob.payload.JobStateURL,
+		})
+	}
+	q.dispatchedJobsMutex.Unlock()
+
+	for i := range state.Jobs {
+		state.Jobs[i].Site = q.siteFor(state.Jobs[i].ID)
+	}
+
+	body, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal http job queue state")
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(q.statePath), filepath.Base(q.statePath))
+	if err != nil {
+		return errors.Wrap(err, "couldn't create http job queue state file")
+	}
+	defer os.Remove(tmpFile.Name())
+
+	err = tmpFile.Chmod(0600)
+	if err == nil {
+		_, err = tmpFile.Write(body)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "couldn't write http job queue state file")
+	}
+
+	return errors.Wrap(os.Rename(tmpFile.Name(), q.statePath), "couldn't replace http job queue state file")
+}
+
+func (q *HTTPJobQueue) saveStateOrWarn() {
+	err := q.saveState()
+	if err != nil {
+		context.LoggerFromContext(gocontext.Background()).WithFields(logrus.Fields{
+			"self": "http_job_queue",
+			"err":  err,
+		}).Warn("couldn't save state file")
+	}
+}
+
+// loadState reads the jobs dispatched before the last shutdown or crash from
+// the state file, if any, to be recovered by RecoverJobs.  State files which
+// can't be parsed, were written by another version, for another job-board or
+// queue, or too long ago are ignored.
+func (q *HTTPJobQueue) loadState() {
+	if q.statePath == "" {
+		return
+	}
+
+	logger := context.LoggerFromContext(gocontext.Background()).WithFields(logrus.Fields{
+		"self": "http_job_queue",
+		"path": q.statePath,
+	})
+
+	body, err := ioutil.ReadFile(q.statePath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't read state file")
+		return
+	}
+
+	state := &httpJobQueueState{}
+	err = json.Unmarshal(body, state)
+	if err != nil {
+		logger.WithField("err", err).Warn("ignoring corrupt state file")
+		q.markReason("state_ignored", "corrupt")
+		return
+	}
+
+	if reason := q.staleStateReason(state); reason != "" {
+		logger.WithField("reason", reason).Warn("ignoring stale state file")
+		q.markReason("state_ignored", "stale")
+		return
+	}
+
+	q.recoveredJobs = state.Jobs
+	logger.WithField("jobs", len(state.Jobs)).Info("loaded state file")
+}
+
+// staleStateReason returns why the given state can't be recovered, if so.
+func (q *HTTPJobQueue) staleStateReason(state *httpJobQueueState) string {
+	if state.Version != httpJobQueueStateVersion {
+		return fmt.Sprintf("version %d", state.Version)
+	}
+	if q.clock.Now().Sub(state.SavedAt) > httpJobQueueStateMaxAge {
+		return fmt.Sprintf("saved at %s", state.SavedAt)
+	}
+
+	cfg := q.stateConfig()
+	if state.Config.JobBoardHost != cfg.JobBoardHost || state.Config.Queue != cfg.Queue {
+		return "different job-board or queue"
+	}
+	return ""
+}
+
+// RecoverJobs hands the jobs dispatched before the last shutdown or crash
+// back to job-board, so that other workers pick them up right away rather
+// than once their claims have gone stale.  Recovered jobs are always handed
+// back rather than resumed, as the processors running them are gone.  It is a no-op unless state
+// persistence is enabled and a recent state file was found.
+func (q *HTTPJobQueue) RecoverJobs(ctx gocontext.Context) error {
+	logger := context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+		"self": "http_job_queue",
+		"inst": fmt.Sprintf("%p", q),
+	})
+
+	recoveredJobs := q.recoveredJobs
+	q.recoveredJobs = nil
+
+	failed := 0
+	for _, rj := range recoveredJobs {
+		q.sitesMutex.Lock()
+		q.jobSites[rj.ID] = rj.Site
+		q.sitesMutex.Unlock()
+
+		buildJob := &httpJob{
+			payload: &httpJobPayload{
+				Data:        &JobPayload{Job: JobJobPayload{ID: rj.ID}},
+				JWT:         rj.JWT,
+				JobStateURL: rj.JobStateURL,
+			},
+		}
+
+		logger.WithField("job_id", rj.ID).Info("requeueing job recovered from state file")
+		jobCtx := context.FromJWT(context.FromJobID(ctx, rj.ID), rj.JWT)
+
+		err := buildJob.Requeue(jobCtx)
+		if err == nil {
+			err = q.deleteJob(jobCtx, rj.ID)
+		}
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"err":    err,
+				"job_id": rj.ID,
+			}).Error("couldn't requeue job recovered from state file")
+			q.forgetJobSite(rj.ID)
+			failed++
+			continue
+		}
+
+		q.markReason("requeued", "recovery")
+	}
+
+	err := q.saveState()
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return errors.Errorf("couldn't requeue %d of %d recovered jobs", failed, len(recoveredJobs))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gocontext "context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPJobQueue_State(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-job-queue-state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var jobBoardURL *url.URL
+	states := []string{}
+	deleted := []string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/jobs/100001/state`, func(w http.ResponseWriter, req *http.Request) {
+		body := map[string]interface{}{}
+		assert.Nil(t, json.NewDecoder(req.Body).Decode(&body))
+		newState, _ := body["new"].(string)
+		states = append(states, newState)
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc(`/jobs/100001`, func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "DELETE", req.Method)
+		deleted = append(deleted, req.Header.Get("Travis-Site"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	jobBoardServer := httptest.NewServer(mux)
+	defer jobBoardServer.Close()
+	jobBoardURL, _ = url.Parse(jobBoardServer.URL)
+
+	cfg := &HTTPJobQueueConfig{
+		JobBoardURL: jobBoardURL,
+		Queue:       "builds.test",
+		Sites:       []string{"org", "com"},
+		StatePath:   filepath.Join(dir, "state.json"),
+	}
+	hjq, err := NewHTTPJobQueueWithConfig(cfg, nil)
+	assert.Nil(t, err)
+	assert.Len(t, hjq.recoveredJobs, 0)
+
+	hjq.jobSites[100001] = "com"
+	hjq.trackDispatchedJob(100001, &httpJob{payload: &httpJobPayload{
+		JWT:         "fafafaf",
+		JobStateURL: fmt.Sprintf("%s/jobs/{job_id}/state", jobBoardURL.String()),
+	}})
+	hjq.trackDispatchedJob(100002, &httpJob{payload: &httpJobPayload{}})
+	hjq.untrackDispatchedJob(100002)
+
+	info, err := os.Stat(cfg.StatePath)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	hjq, err = NewHTTPJobQueueWithConfig(cfg, nil)
+	assert.Nil(t, err)
+	assert.Len(t, hjq.recoveredJobs, 1)
+
+	assert.Nil(t, hjq.RecoverJobs(gocontext.TODO()))
+	assert.Equal(t, []string{"created"}, states)
+	assert.Equal(t, []string{"com"}, deleted)
+
+	hjq, err = NewHTTPJobQueueWithConfig(cfg, nil)
+	assert.Nil(t, err)
+	assert.Len(t, hjq.recoveredJobs, 0)
+}
+
+func TestHTTPJobQueue_State_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-job-queue-state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	statePath := filepath.Join(dir, "state.json")
+	jobBoardURL, _ := url.Parse("http://job-board.example.org")
+	savedAt := time.Now().UTC().Format(time.RFC3339)
+
+	for _, body := range []string{
+		`{"version":1,"jobs":[{"id":1`,
+		`{"version":2,"saved_at":"` + savedAt + `","config":{"job_board_host":"job-board.example.org","queue":"builds.test"},"jobs":[{"id":1}]}`,
+		`{"version":1,"saved_at":"2011-04-01T11:05:55Z","config":{"job_board_host":"job-board.example.org","queue":"builds.test"},"jobs":[{"id":1}]}`,
+		`{"version":1,"saved_at":"` + savedAt + `","config":{"job_board_host":"job-board.example.com","queue":"builds.test"},"jobs":[{"id":1}]}`,
+		`{"version":1,"saved_at":"` + savedAt + `","config":{"job_board_host":"job-board.example.org","queue":"builds.other"},"jobs":[{"id":1}]}`,
+	} {
+		assert.Nil(t, ioutil.WriteFile(statePath, []byte(body), 0600))
+
+		hjq, err := NewHTTPJobQueueWithConfig(&HTTPJobQueueConfig{
+			JobBoardURL: jobBoardURL,
+			Queue:       "builds.test",
+			StatePath:   statePath,
+		}, nil)
+		assert.Nil(t, err, body)
+		assert.Len(t, hjq.recoveredJobs, 0, body)
+	}
+}
@@ -0,0 +1,275 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHTTPRecorderMaxBytes = int64(10 * 1024 * 1024)
+	httpRecorderRedacted        = "[REDACTED]"
+)
+
+var (
+	httpRecorderRedactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+	httpRecorderRedactedKeys    = map[string]bool{
+		"jwt":               true,
+		"job_script":        true,
+		"env_vars":          true,
+		"ssh_key":           true,
+		"cache_settings":    true,
+		"access_key_id":     true,
+		"secret_access_key": true,
+		"password":          true,
+	}
+)
+
+// httpRecorder is an http.RoundTripper that records each request and response
+// passing through it as a line of JSON.  Credentials and secrets are redacted
+// before anything is written, and the file is rotated to a single ".1" backup
+// once it grows beyond the maximum size.
+type httpRecorder struct {
+	transport http.RoundTripper
+	path      string
+	maxBytes  int64
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+type httpRecording struct {
+	Time       time.Time             `json:"time"`
+	DurationMS float64               `json:"duration_ms"`
+	Request    *httpRecordedRequest  `json:"request"`
+	Response   *httpRecordedResponse `json:"response,omitempty"`
+	Error      string                `json:"error,omitempty"`
+}
+
+type httpRecordedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body,omitempty"`
+}
+
+type httpRecordedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body,omitempty"`
+}
+
+func newHTTPRecorder(transport http.RoundTripper, path string, maxBytes int64) (*httpRecorder, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultHTTPRecorderMaxBytes
+	}
+
+	r := &httpRecorder{
+		transport: transport,
+		path:      path,
+		maxBytes:  maxBytes,
+	}
+
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// RoundTrip performs the request with the wrapped transport and records both
+// the request and the response.
+func (r *httpRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := &httpRecording{
+		Time: time.Now().UTC(),
+		Request: &httpRecordedRequest{
+			Method: req.Method,
+			URL:    redactHTTPRecorderURL(req),
+			Header: redactHTTPRecorderHeader(req.Header),
+		},
+	}
+
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't read request body for recording")
+		}
+
+		req = req.WithContext(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		rec.Request.Body = redactHTTPRecorderBody(body)
+	}
+
+	resp, err := r.transport.RoundTrip(req)
+	rec.DurationMS = time.Since(rec.Time).Seconds() * 1e3
+
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	if resp != nil {
+		rec.Response = &httpRecordedResponse{
+			StatusCode: resp.StatusCode,
+			Header:     redactHTTPRecorderHeader(resp.Header),
+		}
+
+		if resp.Body != nil {
+			body, readErr := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			resp.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), &httpRecorderErrReader{err: readErr}))
+			rec.Response.Body = redactHTTPRecorderBody(body)
+			if readErr != nil && rec.Error == "" {
+				rec.Error = readErr.Error()
+			}
+		}
+	}
+
+	r.write(rec)
+
+	return resp, err
+}
+
+// httpRecorderErrReader returns the error the recorder got reading a response
+// body, once the bytes read before it have been consumed, so that the caller
+// sees the same truncated body as it would have without recording.
+type httpRecorderErrReader struct {
+	err error
+}
+
+func (r *httpRecorderErrReader) Read(p []byte) (int, error) {
+	if r.err == nil {
+		return 0, io.EOF
+	}
+	return 0, r.err
+}
+
+// Close closes the recording file.
+func (r *httpRecorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *httpRecorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "couldn't open http recording file")
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "couldn't stat http recording file")
+	}
+
+	r.file = file
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *httpRecorder) write(rec *httpRecording) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	if r.size > 0 && r.size+int64(len(line)) > r.maxBytes {
+		r.file.Close()
+		r.file = nil
+
+		_ = os.Rename(r.path, r.path+".1")
+		if r.open() != nil {
+			return
+		}
+	}
+
+	n, _ := r.file.Write(line)
+	r.size += int64(n)
+}
+
+func redactHTTPRecorderURL(req *http.Request) string {
+	u := *req.URL
+	if u.User != nil {
+		u.User = nil
+	}
+	return u.String()
+}
+
+func redactHTTPRecorderHeader(header http.Header) http.Header {
+	redacted := http.Header{}
+	for key, values := range header {
+		redacted[key] = values
+	}
+
+	for _, key := range httpRecorderRedactedHeaders {
+		if redacted.Get(key) != "" {
+			redacted.Set(key, httpRecorderRedacted)
+		}
+	}
+
+	return redacted
+}
+
+// redactHTTPRecorderBody redacts the values of any secret keys in a JSON body.
+// Bodies that aren't JSON are redacted entirely, as they can't be inspected.
+func redactHTTPRecorderBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return httpRecorderRedacted
+	}
+
+	redacted, err := json.Marshal(redactHTTPRecorderValue(v))
+	if err != nil {
+		return httpRecorderRedacted
+	}
+
+	return string(redacted)
+}
+
+func redactHTTPRecorderValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, inner := range value {
+			if httpRecorderRedactedKeys[key] {
+				value[key] = httpRecorderRedacted
+				continue
+			}
+			value[key] = redactHTTPRecorderValue(inner)
+		}
+	case []interface{}:
+		for i, inner := range value {
+			value[i] = redactHTTPRecorderValue(inner)
+		}
+	}
+
+	return v
+}
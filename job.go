@@ -1,11 +1,13 @@
 package worker
 
 import (
+	"encoding/json"
 	"time"
 
 	gocontext "context"
 
 	"github.com/bitly/go-simplejson"
+	"github.com/pkg/errors"
 	"github.com/travis-ci/worker/backend"
 )
 
@@ -21,8 +23,8 @@ type jobPayloadStartAttrs struct {
 	VmConfig *backend.VmConfig        `json:"vm_config"`
 }
 
-type httpJobPayloadStartAttrs struct {
-	Data *jobPayloadStartAttrs `json:"data"`
+type httpJobPayloadData struct {
+	Data json.RawMessage `json:"data"`
 }
 
 // JobPayload is the payload we receive over RabbitMQ.
@@ -73,6 +75,40 @@ type TimeoutsPayload struct {
 	LogSilence uint64 `json:"log_silence"`
 }
 
+// parseJobPayload parses a job payload as sent over RabbitMQ (or nested under
+// "data" by job-board) into the payload, its start attributes and the raw
+// JSON. Every job queue builds its jobs with this, so that they all end up
+// with the same start attributes for the same payload.
+func parseJobPayload(body []byte, defaultLanguage, defaultDist, defaultGroup, defaultOS string) (*JobPayload, *backend.StartAttributes, *simplejson.Json, error) {
+	payload := &JobPayload{}
+	err := json.Unmarshal(body, payload)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "payload JSON parse error")
+	}
+
+	startAttrs := &jobPayloadStartAttrs{Config: &backend.StartAttributes{}}
+	err = json.Unmarshal(body, startAttrs)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "start attributes JSON parse error")
+	}
+
+	rawPayload, err := simplejson.NewJson(body)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "raw payload JSON parse error")
+	}
+
+	startAttributes := startAttrs.Config
+	if startAttributes == nil {
+		startAttributes = &backend.StartAttributes{}
+	}
+	startAttributes.VMType = payload.VMType
+	startAttributes.VMConfig = payload.VMConfig
+	startAttributes.Warmer = payload.Warmer
+	startAttributes.SetDefaults(defaultLanguage, defaultDist, defaultGroup, defaultOS, VMTypeDefault, VMConfigDefault)
+
+	return payload, startAttributes, rawPayload, nil
+}
+
 // FinishState is the state that a job finished with (such as pass/fail/etc.).
 // You should not provide a string directly, but use one of the FinishStateX
 // constants defined in this package.
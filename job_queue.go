@@ -4,9 +4,41 @@ import (
 	gocontext "context"
 )
 
-// JobQueue is the minimal interface needed by a ProcessorPool
+// JobQueue is the minimal interface needed by a ProcessorPool, and is
+// implemented by the AMQP, file, HTTP and multi-source job queues.
+//
+// Jobs is called by each processor with the processor's context, and returns
+// the channel that processor receives jobs on.  A queue may share a single
+// source of jobs between callers, or poll separately for each of them, but
+// each caller gets a channel of its own.  The returned channel obeys the
+// following:
+//
+//   - No nil Job is ever sent.  Receiving nil means the channel is closed.
+//   - The channel is closed once the given context is done, and no further
+//     jobs are sent after that.  A queue may also close it when its source is
+//     exhausted, e.g. when its connection is closed, so consumers must check
+//     for a closed channel rather than wait for their context alone.
+//   - A job that has been sent is owned by its receiver.  The queue may hold
+//     off on fetching the next job for that receiver until the job has been
+//     started, finished or requeued, i.e. until the receiver is ready for more
+//     work.  The HTTP queue does so until the job's claim is no longer
+//     refreshed.
+//
+// An error is only returned when the queue is unable to produce jobs at all.
+//
+// Name returns a short name for the queue type, such as "http", for logging.
+//
+// Cleanup releases any resources held by the queue.  It is called once, after
+// every processor has stopped receiving from its jobs channel.
 type JobQueue interface {
 	Jobs(gocontext.Context) (<-chan Job, error)
 	Name() string
 	Cleanup() error
 }
+
+var (
+	_ JobQueue = (*AMQPJobQueue)(nil)
+	_ JobQueue = (*FileJobQueue)(nil)
+	_ JobQueue = (*HTTPJobQueue)(nil)
+	_ JobQueue = (*MultiSourceJobQueue)(nil)
+)
@@ -79,3 +79,19 @@ func TestUnmarshalJobPayload(t *testing.T) {
 	assert.NotNil(t, job.Job.QueuedAt)
 	assert.Exactly(t, time.Unix(1484233200, 0).In(time.UTC), *job.Job.QueuedAt)
 }
+
+func TestParseJobPayload(t *testing.T) {
+	payload, startAttrs, rawPayload, err := parseJobPayload([]byte(jsonPayload), "ruby", "trusty", "stable", "linux")
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint64(191312240), payload.Job.ID)
+	assert.Equal(t, "rust", startAttrs.Language)
+	assert.Equal(t, "precise", startAttrs.Dist)
+	assert.Equal(t, VMTypeDefault, startAttrs.VMType)
+	assert.Equal(t, "lukaspustina/axfrnotify", rawPayload.Get("repository").Get("slug").MustString())
+}
+
+func TestParseJobPayload_Invalid(t *testing.T) {
+	_, _, _, err := parseJobPayload([]byte(`{"job":`), "ruby", "trusty", "stable", "linux")
+	assert.Error(t, err)
+}
@@ -46,15 +46,21 @@ func (msjq *MultiSourceJobQueue) Jobs(ctx gocontext.Context) (outChan <-chan Job
 	}
 
 	go func() {
-		for {
+		defer close(buildJobChan)
+
+		for len(buildJobChans) > 0 {
 			for queueName, bjc := range buildJobChans {
-				var job Job = nil
 				jobSendBegin := time.Now()
 				logger = logger.WithField("queue_name", queueName)
 
 				logger.Debug("about to receive job")
 				select {
-				case job = <-bjc:
+				case job, ok := <-bjc:
+					if !ok {
+						logger.Debug("source job channel closed")
+						delete(buildJobChans, queueName)
+						continue
+					}
 					if job == nil {
 						logger.Debug("skipping nil job")
 						continue
@@ -65,7 +71,11 @@ func (msjq *MultiSourceJobQueue) Jobs(ctx gocontext.Context) (outChan <-chan Job
 					}
 
 					logger.WithField("job_id", jobID).Debug("about to send job to multi source output channel")
-					buildJobChan <- job
+					select {
+					case buildJobChan <- job:
+					case <-ctx.Done():
+						return
+					}
 
 					metrics.TimeSince("travis.worker.job_queue.multi.blocking_time", jobSendBegin)
 					logger.WithFields(logrus.Fields{
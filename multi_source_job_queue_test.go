@@ -105,3 +105,41 @@ func TestMultiSourceJobQueue_Jobs_uniqueChannels(t *testing.T) {
 
 	assert.NotEqual(t, fmt.Sprintf("%#v", buildJobChan0), fmt.Sprintf("%#v", buildJobChan1))
 }
+
+func TestMultiSourceJobQueue_Jobs_closedSources(t *testing.T) {
+	jq0 := &fakeJobQueue{c: make(chan Job)}
+	jq1 := &fakeJobQueue{c: make(chan Job)}
+	msjq := NewMultiSourceJobQueue(jq0, jq1)
+
+	buildJobChan, err := msjq.Jobs(gocontext.TODO())
+	assert.Nil(t, err)
+
+	close(jq0.c)
+	close(jq1.c)
+
+	select {
+	case job, ok := <-buildJobChan:
+		assert.Nil(t, job)
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "jobs channel was not closed after sources were closed")
+	}
+}
+
+func TestMultiSourceJobQueue_Jobs_contextDone(t *testing.T) {
+	jq0 := &fakeJobQueue{c: make(chan Job)}
+	msjq := NewMultiSourceJobQueue(jq0)
+
+	ctx, cancel := gocontext.WithCancel(gocontext.TODO())
+	buildJobChan, err := msjq.Jobs(ctx)
+	assert.Nil(t, err)
+
+	cancel()
+
+	select {
+	case _, ok := <-buildJobChan:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "jobs channel was not closed after context was done")
+	}
+}
@@ -42,3 +42,14 @@ func stringSplitSpace(s string) []string {
 	}
 	return parts
 }
+
+func stringSplitComma(s string) []string {
+	parts := []string{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
@@ -130,6 +130,7 @@ func (fj *fakeJob) Name() string { return "fake" }
 
 type fakeLogWriter struct {
 	broken bool
+	closed bool
 }
 
 func (flw *fakeLogWriter) Write(_ []byte) (int, error) {
@@ -143,6 +144,7 @@ func (flw *fakeLogWriter) Close() error {
 	if flw.broken {
 		return errors.New("failed to close")
 	}
+	flw.closed = true
 	return nil
 }
 
@@ -150,6 +152,7 @@ func (flw *fakeLogWriter) WriteAndClose(_ []byte) (int, error) {
 	if flw.broken {
 		return 0, errors.New("failed to write and close")
 	}
+	flw.closed = true
 	return 0, nil
 }
 
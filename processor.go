@@ -1,6 +1,7 @@
 package worker
 
 import (
+	"sync"
 	"time"
 
 	gocontext "context"
@@ -38,12 +39,20 @@ type Processor struct {
 	// Processor.
 	ProcessedCount int
 
+	// statusMutex guards CurrentStatus, LastJobID and IdleSince, which are
+	// read from other goroutines through Status while the processor runs.
+	statusMutex sync.Mutex
+
 	// CurrentStatus contains the current status of the processor, and can
 	// be one of "new", "waiting", "processing" or "done".
 	CurrentStatus string
 
 	// LastJobID contains the ID of the last job the processor processed.
 	LastJobID uint64
+
+	// IdleSince contains when the processor last finished processing a job
+	// and went back to "waiting", and is zero until then.
+	IdleSince time.Time
 }
 
 type ProcessorConfig struct {
@@ -95,7 +104,11 @@ func (p *Processor) Run() {
 	logger := context.LoggerFromContext(p.ctx).WithField("self", "processor")
 	logger.Info("starting processor")
 	defer logger.Info("processor done")
-	defer func() { p.CurrentStatus = "done" }()
+	defer func() {
+		p.statusMutex.Lock()
+		p.CurrentStatus = "done"
+		p.statusMutex.Unlock()
+	}()
 
 	for {
 		select {
@@ -147,8 +160,10 @@ func (p *Processor) Run() {
 				"job_id": jobID,
 				"status": "processing",
 			}).Debug("updating processor status and last id")
+			p.statusMutex.Lock()
 			p.LastJobID = jobID
 			p.CurrentStatus = "processing"
+			p.statusMutex.Unlock()
 
 			p.process(ctx, buildJob)
 
@@ -156,7 +171,10 @@ func (p *Processor) Run() {
 				"job_id": jobID,
 				"status": "waiting",
 			}).Debug("updating processor status")
+			p.statusMutex.Lock()
+			p.IdleSince = time.Now()
 			p.CurrentStatus = "waiting"
+			p.statusMutex.Unlock()
 		case <-time.After(10 * time.Second):
 			logger.Debug("timeout waiting for job, shutdown, or context done")
 		}
@@ -279,16 +297,29 @@ func (p *Processor) process(ctx gocontext.Context, buildJob Job) {
 	if buildJob.Requeued() {
 		fields["requeued"] = 1
 	}
+	if reason, ok := state.Get("cancelReason").(CancellationReason); ok {
+		fields["cancel_reason"] = reason
+	}
 	logger.WithFields(fields).Info("finished job")
 
 	p.ProcessedCount++
 }
 
+// Status returns the current status of the processor, the ID of the last job
+// it processed, and when it last went back to "waiting".
+func (p *Processor) Status() (status string, lastJobID uint64, idleSince time.Time) {
+	p.statusMutex.Lock()
+	defer p.statusMutex.Unlock()
+
+	return p.CurrentStatus, p.LastJobID, p.IdleSince
+}
+
 func (p *Processor) processorInfo() processorInfo {
+	status, lastJobID, _ := p.Status()
 	return processorInfo{
 		ID:        p.ID,
 		Processed: p.ProcessedCount,
-		Status:    p.CurrentStatus,
-		LastJobID: p.LastJobID,
+		Status:    status,
+		LastJobID: lastJobID,
 	}
 }
@@ -18,7 +18,12 @@ type RemoteController struct {
 	pool       *ProcessorPool
 	auth       string
 	workerInfo func() workerInfo
+	queueInfo  func() (interface{}, bool)
 	cancel     func()
+
+	// metrics serves metrics at /metrics, behind the same auth as the rest
+	// of the API, if set.
+	metrics http.Handler
 }
 
 // Setup installs the HTTP routes that will handle requests to the HTTP API.
@@ -32,11 +37,17 @@ func (api *RemoteController) Setup() {
 	r.HandleFunc("/worker", api.UpdateWorkerInfo).Methods("PATCH")
 	r.HandleFunc("/worker", api.ShutdownWorker).Methods("DELETE")
 
+	r.HandleFunc("/queue", api.GetQueueInfo).Methods("GET")
+
 	// It is preferable to use UpdateWorkerInfo to update the pool size,
 	// as it does not depend on the current state of worker.
 	r.HandleFunc("/pool/increment", api.IncrementPool).Methods("POST")
 	r.HandleFunc("/pool/decrement", api.DecrementPool).Methods("POST")
 
+	if api.metrics != nil {
+		r.Handle("/metrics", api.metrics).Methods("GET")
+	}
+
 	r.Use(api.SetContext)
 	r.Use(api.CheckAuth)
 	http.Handle("/", r)
@@ -123,6 +134,30 @@ func (api *RemoteController) GetWorkerInfo(w http.ResponseWriter, req *http.Requ
 	json.NewEncoder(w).Encode(info)
 }
 
+// GetQueueInfo writes a JSON payload with the status of the job queue, if the
+// job queue reports one.
+func (api *RemoteController) GetQueueInfo(w http.ResponseWriter, req *http.Request) {
+	log := context.LoggerFromContext(req.Context()).WithField("method", "GetQueueInfo")
+
+	var info interface{}
+	ok := false
+	if api.queueInfo != nil {
+		info, ok = api.queueInfo()
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse{
+			Message: "job queue status is not available",
+		})
+		return
+	}
+	log.Info("got queue info")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
 // UpdateWorkerInfo allows reconfiguring some parts of worker on the fly.
 //
 // The main use of this is adjusting the size of the processor pool without
@@ -0,0 +1,117 @@
+package worker
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ResourceMonitor reports whether the host is under enough resource pressure
+// that no more jobs should be taken on, along with why if so.
+type ResourceMonitor interface {
+	UnderPressure() (string, bool, error)
+}
+
+// SystemResourceMonitor is a ResourceMonitor reporting pressure when the
+// available memory or the load average of the host crosses a threshold.  It
+// reads /proc, and is therefore only supported on Linux.
+type SystemResourceMonitor struct {
+	// MinAvailableMemoryBytes is the available memory below which the host is
+	// under pressure.  Memory isn't checked when 0.
+	MinAvailableMemoryBytes int64
+
+	// MaxLoadPerCPU is the one-minute load average per CPU above which the
+	// host is under pressure.  The load isn't checked when 0.
+	MaxLoadPerCPU float64
+
+	meminfoPath string
+	loadavgPath string
+	numCPU      int
+}
+
+// NewSystemResourceMonitor creates a SystemResourceMonitor with the given
+// thresholds, either of which may be 0 to not check that resource.
+func NewSystemResourceMonitor(minAvailableMemoryBytes int64, maxLoadPerCPU float64) *SystemResourceMonitor {
+	return &SystemResourceMonitor{
+		MinAvailableMemoryBytes: minAvailableMemoryBytes,
+		MaxLoadPerCPU:           maxLoadPerCPU,
+
+		meminfoPath: "/proc/meminfo",
+		loadavgPath: "/proc/loadavg",
+		numCPU:      runtime.NumCPU(),
+	}
+}
+
+// UnderPressure checks the available memory and the load average against the
+// configured thresholds.
+func (m *SystemResourceMonitor) UnderPressure() (string, bool, error) {
+	if m.MinAvailableMemoryBytes > 0 {
+		available, err := m.availableMemoryBytes()
+		if err != nil {
+			return "", false, err
+		}
+		if available < m.MinAvailableMemoryBytes {
+			return fmt.Sprintf("available memory %d bytes below %d bytes", available, m.MinAvailableMemoryBytes), true, nil
+		}
+	}
+
+	if m.MaxLoadPerCPU > 0 {
+		load, err := m.loadAverage()
+		if err != nil {
+			return "", false, err
+		}
+		if loadPerCPU := load / float64(m.numCPU); loadPerCPU > m.MaxLoadPerCPU {
+			return fmt.Sprintf("load average %.2f per cpu above %.2f", loadPerCPU, m.MaxLoadPerCPU), true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+func (m *SystemResourceMonitor) availableMemoryBytes() (int64, error) {
+	f, err := os.Open(m.meminfoPath)
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't open meminfo")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, errors.Wrap(err, "couldn't parse available memory")
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, errors.Wrap(err, "couldn't read meminfo")
+	}
+
+	return 0, errors.New("no available memory in meminfo")
+}
+
+func (m *SystemResourceMonitor) loadAverage() (float64, error) {
+	body, err := ioutil.ReadFile(m.loadavgPath)
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't read loadavg")
+	}
+
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return 0, errors.New("empty loadavg")
+	}
+
+	load, err := strconv.ParseFloat(fields[0], 64)
+	return load, errors.Wrap(err, "couldn't parse load average")
+}
@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSystemResourceMonitor(t *testing.T, meminfo, loadavg string) (*SystemResourceMonitor, func()) {
+	dir, err := ioutil.TempDir("", "travis-worker-resource-monitor")
+	assert.Nil(t, err)
+
+	m := NewSystemResourceMonitor(0, 0)
+	m.meminfoPath = filepath.Join(dir, "meminfo")
+	m.loadavgPath = filepath.Join(dir, "loadavg")
+	m.numCPU = 2
+
+	assert.Nil(t, ioutil.WriteFile(m.meminfoPath, []byte(meminfo), 0644))
+	assert.Nil(t, ioutil.WriteFile(m.loadavgPath, []byte(loadavg), 0644))
+
+	return m, func() { os.RemoveAll(dir) }
+}
+
+func TestSystemResourceMonitor_UnderPressure(t *testing.T) {
+	m, cleanup := newTestSystemResourceMonitor(t,
+		"MemTotal:        8000000 kB\nMemFree:          100000 kB\nMemAvailable:     200000 kB\n",
+		"3.00 2.00 1.00 1/100 12345\n")
+	defer cleanup()
+
+	reason, shedding, err := m.UnderPressure()
+	assert.Nil(t, err)
+	assert.False(t, shedding)
+	assert.Equal(t, "", reason)
+
+	m.MinAvailableMemoryBytes = 100000 * 1024
+	_, shedding, err = m.UnderPressure()
+	assert.Nil(t, err)
+	assert.False(t, shedding)
+
+	m.MinAvailableMemoryBytes = 300000 * 1024
+	reason, shedding, err = m.UnderPressure()
+	assert.Nil(t, err)
+	assert.True(t, shedding)
+	assert.Contains(t, reason, "available memory")
+
+	m.MinAvailableMemoryBytes = 0
+	m.MaxLoadPerCPU = 2
+	_, shedding, err = m.UnderPressure()
+	assert.Nil(t, err)
+	assert.False(t, shedding)
+
+	m.MaxLoadPerCPU = 1
+	reason, shedding, err = m.UnderPressure()
+	assert.Nil(t, err)
+	assert.True(t, shedding)
+	assert.Contains(t, reason, "load average")
+}
+
+func TestSystemResourceMonitor_UnderPressure_Malformed(t *testing.T) {
+	m, cleanup := newTestSystemResourceMonitor(t, "MemTotal: 8000000 kB\n", "")
+	defer cleanup()
+
+	m.MinAvailableMemoryBytes = 1
+	_, shedding, err := m.UnderPressure()
+	assert.NotNil(t, err)
+	assert.False(t, shedding)
+
+	m.MinAvailableMemoryBytes = 0
+	m.MaxLoadPerCPU = 1
+	_, shedding, err = m.UnderPressure()
+	assert.NotNil(t, err)
+	assert.False(t, shedding)
+}
@@ -25,9 +25,14 @@ func (s *stepCheckCancellation) Run(state multistep.StateBag) multistep.StepActi
 	case <-cancelChan:
 		ctx := state.Get("ctx").(gocontext.Context)
 		buildJob := state.Get("buildJob").(Job)
+		reason := cancellationReason(state)
+		if reason.silent() {
+			state.Put("err", JobCancelledError)
+			return multistep.ActionHalt
+		}
 		if _, ok := state.GetOk("logWriter"); ok {
 			logWriter := state.Get("logWriter").(LogWriter)
-			s.writeLogAndFinishWithState(ctx, logWriter, buildJob, FinishStateCancelled, "\n\nDone: Job Cancelled\n\n")
+			s.writeLogAndFinishWithState(ctx, logWriter, buildJob, FinishStateCancelled, reason.logMessage())
 		} else {
 			err := buildJob.Finish(ctx, FinishStateCancelled)
 			if err != nil {
@@ -62,6 +62,12 @@ func (s *stepOpenLogWriter) Cleanup(state multistep.StateBag) {
 	ctx, span := trace.StartSpan(ctx, "OpenLogWriter.Cleanup")
 	defer span.End()
 
+	// NOTE: closing the log writer sends the final log part, which must not
+	// be sent for a job that has been handed back to job-board.
+	if reason, ok := state.Get("cancelReason").(CancellationReason); ok && reason.silent() {
+		return
+	}
+
 	logWriter, ok := state.Get("logWriter").(LogWriter)
 	if ok {
 		logWriter.Close()
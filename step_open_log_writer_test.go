@@ -48,3 +48,21 @@ func TestStepOpenLogWriter_Run(t *testing.T) {
 	assert.Equal(t, multistep.ActionContinue, action)
 	assert.NotNil(t, state.Get("logWriter"))
 }
+
+func TestStepOpenLogWriter_Cleanup(t *testing.T) {
+	for reason, closed := range map[CancellationReason]bool{
+		"":                           true,
+		CancellationReasonRequested:  true,
+		CancellationReasonHandedBack: false,
+	} {
+		s, state := setupStepOpenLogWriter()
+		logWriter := &fakeLogWriter{}
+		state.Put("logWriter", logWriter)
+		if reason != "" {
+			state.Put("cancelReason", reason)
+		}
+
+		s.Cleanup(state)
+		assert.Equal(t, closed, logWriter.closed, string(reason))
+	}
+}
@@ -132,17 +132,32 @@ func (s *stepRunScript) Run(state multistep.StateBag) multistep.StepAction {
 			return multistep.ActionContinue
 		}
 
-		logger.Info("context was cancelled, stopping job")
+		reason := CancellationReasonTerminated
+		select {
+		case <-cancelChan:
+			// NOTE: a job handed back on shutdown is cancelled along with
+			// the context, and must stay silent either way.
+			reason = cancellationReason(state)
+		default:
+			state.Put("cancelReason", reason)
+		}
+		logger.WithField("cancel_reason", reason).Info("context was cancelled, stopping job")
 		return multistep.ActionHalt
 	case <-cancelChan:
 		state.Put("err", JobCancelledError)
+		reason := cancellationReason(state)
+		logger.WithField("cancel_reason", reason).Info("job was cancelled, stopping job")
 
 		span.SetStatus(trace.Status{
 			Code:    trace.StatusCodeUnavailable,
 			Message: JobCancelledError.Error(),
 		})
 
-		s.writeLogAndFinishWithState(preTimeoutCtx, ctx, logWriter, buildJob, FinishStateCancelled, "\n\nDone: Job Cancelled\n\n")
+		if reason.silent() {
+			return multistep.ActionHalt
+		}
+
+		s.writeLogAndFinishWithState(preTimeoutCtx, ctx, logWriter, buildJob, FinishStateCancelled, reason.logMessage())
 
 		return multistep.ActionHalt
 	case <-logWriter.Timeout():
@@ -26,6 +26,7 @@ func (s *stepSubscribeCancellation) Run(state multistep.StateBag) multistep.Step
 	buildJob := state.Get("buildJob").(Job)
 	ch := s.cancellationBroadcaster.Subscribe(buildJob.Payload().Job.ID)
 	state.Put("cancelChan", ch)
+	state.Put("cancellationBroadcaster", s.cancellationBroadcaster)
 
 	return multistep.ActionContinue
 }
@@ -44,3 +45,19 @@ func (s *stepSubscribeCancellation) Cleanup(state multistep.StateBag) {
 	ch := state.Get("cancelChan").(<-chan struct{})
 	s.cancellationBroadcaster.Unsubscribe(buildJob.Payload().Job.ID, ch)
 }
+
+// cancellationReason returns why the job was cancelled once its cancelChan
+// has been closed, defaulting to CancellationReasonRequested, and puts it in
+// the state as "cancelReason" for the processor to log.
+func cancellationReason(state multistep.StateBag) CancellationReason {
+	reason := CancellationReasonRequested
+	if cb, ok := state.GetOk("cancellationBroadcaster"); ok {
+		ch := state.Get("cancelChan").(<-chan struct{})
+		if r := cb.(*CancellationBroadcaster).Reason(ch); r != "" {
+			reason = r
+		}
+	}
+
+	state.Put("cancelReason", reason)
+	return reason
+}